@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Revolyssup/apisix-session-manager/session"
+	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
+	"go.uber.org/zap/zapcore"
+)
+
+// Phases of APISIX in which the runner is called. Both should carry the same session_manager config.
+var pluginPhases = []string{"ext-plugin-pre-req", "ext-plugin-post-resp"}
+
+// adminClient talks to the admin API of a running runner, over a unix socket or TCP
+type adminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newAdminClient(addr string, token string) (*adminClient, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("admin address is required, pass -addr or set %s", adminAddrEnv)
+	}
+	c := &adminClient{
+		base:   "http://" + addr,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		c.base = "http://session-manager"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c, nil
+}
+
+func (c *adminClient) do(method string, path string, out interface{}) error {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &apiErr)
+		return fmt.Errorf("admin API returned %d: %s", resp.StatusCode, apiErr.Error)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// sessionSummary mirrors what the admin API returns for a session
+type sessionSummary struct {
+	ID        string    `json:"id"`
+	Identity  string    `json:"identity"`
+	Cohort    string    `json:"cohort"`
+	Breaker   string    `json:"breaker"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func sessionsCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected one of list, show, revoke")
+	}
+	fs := flag.NewFlagSet("sessions "+args[0], flag.ContinueOnError)
+	addr := fs.String("addr", os.Getenv(adminAddrEnv), "address of the admin API")
+	token := fs.String("token", os.Getenv(adminTokenEnv), "admin token")
+	identity := fs.String("identity", "", "only sessions of this identity (API key fingerprint)")
+	all := fs.Bool("all", false, "revoke every session")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	c, err := newAdminClient(*addr, *token)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		var out struct {
+			Sessions []sessionSummary `json:"sessions"`
+		}
+		if err := c.do(http.MethodGet, "/sessions?identity="+url.QueryEscape(*identity), &out); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tIDENTITY\tCOHORT\tBREAKER\tCREATED\tLAST SEEN")
+		for _, s := range out.Sessions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Identity, s.Cohort, s.Breaker, s.CreatedAt.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case "show":
+		if fs.NArg() != 1 {
+			return errors.New("expected a session ID")
+		}
+		var out map[string]interface{}
+		if err := c.do(http.MethodGet, "/sessions/"+url.PathEscape(fs.Arg(0)), &out); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	case "revoke":
+		path := ""
+		switch {
+		case fs.NArg() == 1:
+			path = "/sessions/" + url.PathEscape(fs.Arg(0))
+		case *identity != "":
+			path = "/sessions?identity=" + url.QueryEscape(*identity)
+		case *all:
+			path = "/sessions?all=true"
+		default:
+			return errors.New("expected a session ID, -identity or -all")
+		}
+		var out struct {
+			Removed int `json:"removed"`
+		}
+		if err := c.do(http.MethodDelete, path, &out); err != nil {
+			return err
+		}
+		fmt.Printf("revoked %d session(s)\n", out.Removed)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func configCmd(args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		return errors.New("expected: config validate [-config <file>] <file>")
+	}
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "runner config file providing route defaults and secrets")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected: config validate [-config <file>] <file>")
+	}
+	file := fs.Arg(0)
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	rc, err := loadRunnerConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	i := session.New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	if err := rc.configure(i); err != nil {
+		return err
+	}
+	confs, err := pluginConfs(raw, i.Name())
+	if err != nil {
+		return err
+	}
+	if len(confs) == 0 {
+		return fmt.Errorf("no %s config found", i.Name())
+	}
+	failed := false
+	fingerprints := make(map[string]bool)
+	for _, conf := range confs {
+		cfg, err := i.ParseConf([]byte(conf.value)) //ParseConf checks the config against the embedded schema.json as well
+		if err != nil {
+			failed = true
+			fmt.Printf("%s: %s: %s\n", file, conf.phase, err.Error())
+			continue
+		}
+		fingerprints[cfg.(session.Config).Fingerprint()] = true
+		fmt.Printf("%s: %s: ok\n", file, conf.phase)
+	}
+	if failed {
+		return errors.New("invalid config")
+	}
+	if len(fingerprints) > 1 {
+		return fmt.Errorf("%s: configs differ between %s", file, strings.Join(pluginPhases, " and "))
+	}
+	return nil
+}
+
+type phaseConf struct {
+	phase string
+	value string
+}
+
+// pluginConfs extracts the configs of the plugin called name from a route, by phase. A file which is not a route is taken to be the plugin config itself.
+func pluginConfs(raw []byte, name string) ([]phaseConf, error) {
+	var route struct {
+		Plugins map[string]json.RawMessage `json:"plugins"`
+	}
+	if err := json.Unmarshal(raw, &route); err != nil {
+		return nil, err
+	}
+	if route.Plugins == nil {
+		return []phaseConf{{phase: "config", value: string(raw)}}, nil
+	}
+	var confs []phaseConf
+	for _, phase := range pluginPhases {
+		if route.Plugins[phase] == nil {
+			continue
+		}
+		var ext struct {
+			Conf []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"conf"`
+		}
+		if err := json.Unmarshal(route.Plugins[phase], &ext); err != nil {
+			return nil, fmt.Errorf("%s: %w", phase, err)
+		}
+		for _, conf := range ext.Conf {
+			if conf.Name == name {
+				confs = append(confs, phaseConf{phase: phase, value: conf.Value})
+			}
+		}
+	}
+	return confs, nil
+}
+
+func keygenCmd(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	size := fs.Int("bytes", 32, "length of the secret in bytes, 32 fits AES-256 and HMAC-SHA256")
+	format := fs.String("format", "base64", "encoding of the secret: base64 or hex")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *size < 16 {
+		return errors.New("secrets shorter than 16 bytes are not allowed")
+	}
+	secret := make([]byte, *size)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	switch *format {
+	case "base64":
+		fmt.Println(base64.StdEncoding.EncodeToString(secret))
+	case "hex":
+		fmt.Println(hex.EncodeToString(secret))
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return nil
+}
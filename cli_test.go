@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluginConfs(t *testing.T) {
+	files, err := filepath.Glob("configs/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if filepath.Base(file) == "keyauthconsumer.json" { //A consumer, not a route
+			continue
+		}
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		confs, err := pluginConfs(raw, "session_manager")
+		if err != nil {
+			t.Fatalf("%s: %s", file, err.Error())
+		}
+		if len(confs) != len(pluginPhases) {
+			t.Fatalf("%s: expected a config for each of %v, found %d", file, pluginPhases, len(confs))
+		}
+		if err := configCmd([]string{"validate", file}); err != nil {
+			t.Fatalf("%s: %s", file, err.Error())
+		}
+	}
+}
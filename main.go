@@ -1,20 +1,159 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/Revolyssup/apisix-session-manager/session"
 	"github.com/apache/apisix-go-plugin-runner/pkg/plugin"
 	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
-	"go.uber.org/zap/zapcore"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
+// The following variables override the matching settings of the runner config file, see runnerConfig.
+
+// Address of the HTTP listener exposing Prometheus metrics, e.g. ":9095". Metrics are not served when unset.
+const metricsAddrEnv = "SESSION_MANAGER_METRICS_ADDR"
+
+// Address of the admin API, either "unix:/path/to/sock" or a loopback address like "127.0.0.1:9096", and the token it requires.
+// The admin API is not served when the address is unset. The token can also be read from a file, see adminTokenFileEnv.
+const (
+	adminAddrEnv  = "SESSION_MANAGER_ADMIN_ADDR"
+	adminTokenEnv = "SESSION_MANAGER_ADMIN_TOKEN"
+)
+
+// Sink of the structured audit stream: "stdout", "stderr" or the path of a file. The audit stream is disabled when unset.
+const auditLogEnv = "SESSION_MANAGER_AUDIT_LOG"
+
+// Spans are exported over OTLP/HTTP only when one of the standard OpenTelemetry endpoint variables is set.
+var otlpEndpointEnvs = []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"}
+
+const usage = `Usage: session-manager <command> [arguments]
+
+Commands:
+  serve [-config <file>]           run the plugin runner (default)
+  sessions list [-identity <fp>]   list sessions through the admin API
+  sessions show <id>               show one session
+  sessions revoke <id>             revoke one session, or all sessions of -identity, or every session with -all
+  config validate [-config <file>] <file>
+                                   check a route config or a plugin config, with the defaults and secrets of a runner config
+  keygen [-bytes n] [-format f]    generate a random secret
+`
+
 func main() {
+	cmd, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+	var err error
+	switch cmd {
+	case "serve", "run": //APISIX starts runners with "run"
+		err = serve(args)
+	case "sessions":
+		err = sessionsCmd(args)
+	case "config":
+		err = configCmd(args)
+	case "keygen":
+		err = keygenCmd(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err.Error())
+		os.Exit(1)
+	}
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(configFileEnv), "runner config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	rc, err := loadRunnerConfig(*configFile)
+	if err != nil {
+		return err
+	}
 	cfg := runner.RunnerConfig{
-		LogLevel: zapcore.DebugLevel,
+		LogLevel: rc.logLevel,
+	}
+	opts := []session.Option{session.WithLogFormat(rc.Log.Format), session.WithMaxSessions(rc.Store.MaxSessions, rc.Store.MaxUnauthenticatedSessions), session.WithFingerprintKey(rc.fingerprintKey)}
+	if tp := newTracerProvider(); tp != nil {
+		defer tp.Shutdown(context.Background())
+		opts = append(opts, session.WithTracerProvider(tp))
+	}
+	if target := rc.Audit.Output; target != "" {
+		sink, err := session.OpenAuditSink(target)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, session.WithAuditOutput(sink))
+	}
+	if rc.Shutdown.Snapshot != "" {
+		opts = append(opts, session.WithSnapshot(rc.Shutdown.Snapshot, rc.snapshotKey))
+	}
+	i := session.New(cfg, opts...)
+	if err := rc.configure(i); err != nil {
+		return err
+	}
+	if err := plugin.RegisterPlugin(i); err != nil {
+		return fmt.Errorf("failed to register plugin: %w", err)
+	}
+	if addr := rc.Metrics.Addr; addr != "" {
+		go func() {
+			if err := i.ServeMetrics(addr); err != nil {
+				log.Fatalf("failed to serve metrics: %s", err.Error())
+			}
+		}()
+	}
+	if addr := rc.Admin.Addr; addr != "" {
+		go func() {
+			if err := i.ServeAdmin(addr); err != nil {
+				log.Fatalf("failed to serve admin API: %s", err.Error())
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	reloader := newReloader(*configFile, i, rc)
+	go reloader.run(stop)
+	runner.Run(cfg) //Returns on SIGINT and SIGTERM, once the runner socket is closed
+	return shutdown(i, reloader.config())
+}
+
+// shutdown drains the instance and writes the sessions to the snapshot, if configured, for the next start to restore them
+func shutdown(i *session.Instance, rc *runnerConfig) error {
+	i.Drain(rc.drainTimeout())
+	if rc.Shutdown.Snapshot == "" {
+		return nil
+	}
+	if err := i.WriteSnapshot(rc.Shutdown.Snapshot, rc.snapshotKey); err != nil {
+		return fmt.Errorf("failed to write session snapshot: %w", err)
+	}
+	return nil
+}
+
+// newTracerProvider sets up the OTLP exporter, configured through the standard OTEL_* environment variables. It returns nil when tracing is not configured.
+func newTracerProvider() *sdktrace.TracerProvider {
+	configured := false
+	for _, env := range otlpEndpointEnvs {
+		if os.Getenv(env) != "" {
+			configured = true
+		}
+	}
+	if !configured {
+		return nil
 	}
-	if err := plugin.RegisterPlugin(session.New(cfg)); err != nil {
-		log.Fatalf("failed to register plugin: %s", err.Error())
+	exp, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Fatalf("failed to create OTLP exporter: %s", err.Error())
 	}
-	runner.Run(cfg)
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Revolyssup/apisix-session-manager/session"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Editors and secret mounts replace files in several steps, the reload waits for the burst of events to settle
+const reloadDebounce = 200 * time.Millisecond
+
+// reloader re-reads the runner config and the secret files and applies them to a serving instance. The stored sessions are left untouched.
+type reloader struct {
+	path    string
+	i       *session.Instance
+	log     *zap.SugaredLogger //The plugin logger, so that reloads are logged in the configured format and level
+	mx      sync.Mutex
+	current *runnerConfig
+}
+
+func newReloader(path string, i *session.Instance, current *runnerConfig) *reloader {
+	return &reloader{path: path, i: i, log: i.Logger(), current: current}
+}
+
+// reload applies the new settings all at once, or none of them when the config or a secret cannot be read.
+// Settings only read at start are kept as they were.
+func (r *reloader) reload() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	next, err := loadRunnerConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if changed := r.current.restartRequired(next); len(changed) > 0 {
+		r.log.Warnf("runner config: ignoring changes to %s until the next restart", strings.Join(changed, ", "))
+		next.Log.Format = r.current.Log.Format
+		next.Metrics = r.current.Metrics
+		next.Admin.Addr = r.current.Admin.Addr
+		next.Audit = r.current.Audit
+	}
+	if next.Shutdown.Snapshot != r.current.Shutdown.Snapshot {
+		r.log.Infof("runner config: sessions will be written to %q on shutdown", next.Shutdown.Snapshot)
+	}
+	if err := next.configure(r.i); err != nil {
+		return err
+	}
+	r.current = next
+	return nil
+}
+
+// config is the runner config currently applied
+func (r *reloader) config() *runnerConfig {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.current
+}
+
+// watchedFiles are the config file and the secret files of the current config
+func (r *reloader) watchedFiles() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	files := r.current.secretFiles()
+	if r.path != "" {
+		files = append(files, r.path)
+	}
+	return files
+}
+
+// run reloads on SIGHUP and whenever the config file or a secret file changes. It blocks until stop is closed.
+func (r *reloader) run(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.log.Warnf("runner config: not watching files, reload with SIGHUP: %s", err.Error())
+	} else {
+		defer watcher.Close()
+		r.watch(watcher)
+	}
+	var events chan fsnotify.Event
+	var errs chan error
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			debounce = time.After(0)
+		case ev := <-events:
+			if r.concerns(ev.Name) {
+				debounce = time.After(reloadDebounce)
+			}
+		case err := <-errs:
+			r.log.Errorf("runner config: watch error: %s", err.Error())
+		case <-debounce:
+			debounce = nil
+			if err := r.reload(); err != nil {
+				r.log.Errorf("runner config: reload failed, keeping the current settings: %s", err.Error())
+				continue
+			}
+			r.log.Info("runner config: reloaded")
+			if watcher != nil {
+				r.watch(watcher) //Secrets may have been added
+			}
+		}
+	}
+}
+
+// watch watches the directories of the watched files rather than the files themselves, as files replaced through a rename
+// (editors, Kubernetes secret and config map mounts) would otherwise drop out of the watch
+func (r *reloader) watch(watcher *fsnotify.Watcher) {
+	for _, file := range r.watchedFiles() {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			r.log.Warnf("runner config: cannot watch %s: %s", file, err.Error())
+		}
+	}
+}
+
+// concerns reports whether a change to name may change a watched file. Kubernetes mounts swap a "..data" symlink rather than the files.
+func (r *reloader) concerns(name string) bool {
+	if strings.HasPrefix(filepath.Base(name), "..") {
+		return true
+	}
+	for _, file := range r.watchedFiles() {
+		if filepath.Clean(name) == filepath.Clean(file) {
+			return true
+		}
+	}
+	return false
+}
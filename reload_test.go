@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/apisix-session-manager/session"
+	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	path := write("runner.json", `{"secrets":{"api":"`+write("api-key", "auth-one")+`"}}`)
+	rc, err := loadRunnerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &lockedBuffer{}
+	i := session.New(runner.RunnerConfig{LogOutput: zapcore.AddSync(logs)}, session.WithLogFormat(session.LogFormatJSON))
+	if err := rc.configure(i); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	r := newReloader(path, i, rc)
+	go r.run(stop)
+	time.Sleep(50 * time.Millisecond) //Let the watcher start
+
+	route := []byte(`{"cookie":"sid","customKeyAuthSecret":"admin"}`)
+	if _, err := i.ParseConf(route); err == nil {
+		t.Fatal("expected a route referring to an unknown secret to be rejected")
+	}
+
+	write("runner.json", `{"secrets":{"api":"`+filepath.Join(dir, "missing")+`"}}`)
+	time.Sleep(4 * reloadDebounce)
+	if files := r.watchedFiles(); len(files) != 2 || files[0] != filepath.Join(dir, "api-key") {
+		t.Fatalf("a config with an unreadable secret should not be applied, found %v", files)
+	}
+
+	write("runner.json", `{"metrics":{"addr":":9999"},"store":{"maxSessions":5},"secrets":{"api":"`+filepath.Join(dir, "api-key")+`","admin":"`+write("admin-key", "admin-one\n")+`"}}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := i.ParseConf(route); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("secrets not reloaded after the config file changed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if files := r.watchedFiles(); len(files) != 3 {
+		t.Fatalf("expected the new secret file to be watched, found %v", files)
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.current.Metrics.Addr != "" {
+		t.Fatalf("metrics.addr requires a restart, found %q", r.current.Metrics.Addr)
+	}
+	if r.current.Store.MaxSessions != 5 {
+		t.Fatalf("expected store.maxSessions to be reloaded along with changes requiring a restart, found %d", r.current.Store.MaxSessions)
+	}
+	if !strings.Contains(logs.String(), `{"level":"warn"`) || !strings.Contains(logs.String(), `"msg":"runner config: ignoring changes to metrics.addr until the next restart"`) {
+		t.Fatalf("expected the reload to be logged by the plugin logger in its format, found %s", logs.String())
+	}
+}
+
+// lockedBuffer collects the logs written from the goroutine of the reloader
+type lockedBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Revolyssup/apisix-session-manager/session"
+	"go.uber.org/zap/zapcore"
+)
+
+// Path of the runner config file, overridden by the -config flag of serve
+const configFileEnv = "SESSION_MANAGER_CONFIG"
+
+// Environment variables overriding the runner config file
+const (
+	logLevelEnv       = "SESSION_MANAGER_LOG_LEVEL"
+	logFormatEnv      = "SESSION_MANAGER_LOG_FORMAT"
+	adminTokenFileEnv = "SESSION_MANAGER_ADMIN_TOKEN_FILE"
+	snapshotEnv       = "SESSION_MANAGER_SNAPSHOT"
+	snapshotKeyEnv    = "SESSION_MANAGER_SNAPSHOT_KEY_FILE"
+	fingerprintKeyEnv = "SESSION_MANAGER_FINGERPRINT_KEY_FILE"
+)
+
+const defaultDrainTimeout = 5 * time.Second
+
+// runnerConfig holds the settings of the runner as a whole, as opposed to the per route session_manager config
+type runnerConfig struct {
+	Log struct {
+		Level  string `json:"level"`  //debug, info, warn or error. Defaults to info
+		Format string `json:"format"` //console or json. Defaults to console
+	} `json:"log"`
+	Defaults json.RawMessage `json:"defaults"` //Route config every route is merged over, e.g. {"cookie": "sid", "sessionTimeoutInSeconds": 3600}
+	Store    struct {
+		MaxSessions                int `json:"maxSessions"`                //Sessions kept before the least recently used ones are evicted, unlimited when 0
+		MaxUnauthenticatedSessions int `json:"maxUnauthenticatedSessions"` //Sessions without a request which passed the auth kept before they are evicted, unlimited when 0
+	} `json:"store"`
+	Secrets map[string]string `json:"secrets"` //Name of the secret to the file holding it. Routes refer to secrets by name, e.g. customKeyAuthSecret
+	Metrics struct {
+		Addr string `json:"addr"`
+	} `json:"metrics"`
+	Admin struct {
+		Addr      string `json:"addr"`
+		TokenFile string `json:"tokenFile"`
+	} `json:"admin"`
+	Audit struct {
+		Output             string `json:"output"`
+		FingerprintKeyFile string `json:"fingerprintKeyFile"` //File holding the key of the fingerprints in logs, traces and the admin API, random on every start when unset
+	} `json:"audit"`
+	Shutdown struct {
+		DrainTimeoutInSeconds int    `json:"drainTimeoutInSeconds"` //Time given to the filter calls in flight to finish before the snapshot is taken, defaults to 5
+		Snapshot              string `json:"snapshot"`              //File the sessions are written to on shutdown and restored from on start. Sessions do not survive a restart when unset
+		SnapshotKeyFile       string `json:"snapshotKeyFile"`       //File holding the AES key encrypting the snapshot, base64 or hex encoded as printed by keygen
+	} `json:"shutdown"`
+
+	logLevel       zapcore.Level
+	adminToken     string
+	secretValues   map[string]string
+	snapshotKey    []byte
+	fingerprintKey []byte
+}
+
+// loadRunnerConfig reads the runner config file at path, if any, applies the environment overrides and loads the secrets
+func loadRunnerConfig(path string) (*runnerConfig, error) {
+	rc := &runnerConfig{}
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(rc); err != nil {
+			return nil, fmt.Errorf("invalid runner config %s: %w", path, err)
+		}
+	}
+	rc.applyEnv()
+	if err := rc.validate(); err != nil {
+		return nil, fmt.Errorf("invalid runner config: %w", err)
+	}
+	if err := rc.loadSecrets(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *runnerConfig) applyEnv() {
+	override := func(field *string, env string) {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	override(&rc.Log.Level, logLevelEnv)
+	override(&rc.Log.Format, logFormatEnv)
+	override(&rc.Metrics.Addr, metricsAddrEnv)
+	override(&rc.Admin.Addr, adminAddrEnv)
+	override(&rc.Admin.TokenFile, adminTokenFileEnv)
+	override(&rc.Audit.Output, auditLogEnv)
+	override(&rc.Shutdown.Snapshot, snapshotEnv)
+	override(&rc.Shutdown.SnapshotKeyFile, snapshotKeyEnv)
+	override(&rc.Audit.FingerprintKeyFile, fingerprintKeyEnv)
+	rc.adminToken = os.Getenv(adminTokenEnv) //Takes precedence over the token file
+}
+
+func (rc *runnerConfig) validate() error {
+	if rc.Log.Level == "" {
+		rc.Log.Level = "info"
+	}
+	if err := rc.logLevel.UnmarshalText([]byte(rc.Log.Level)); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+	switch rc.Log.Format {
+	case "":
+		rc.Log.Format = session.LogFormatConsole
+	case session.LogFormatConsole, session.LogFormatJSON:
+	default:
+		return fmt.Errorf("log.format: expected %s or %s, got %q", session.LogFormatConsole, session.LogFormatJSON, rc.Log.Format)
+	}
+	if rc.Store.MaxSessions < 0 || rc.Store.MaxUnauthenticatedSessions < 0 {
+		return errors.New("store.maxSessions, store.maxUnauthenticatedSessions: must not be negative")
+	}
+	if rc.Store.MaxSessions > 0 && rc.Store.MaxUnauthenticatedSessions > rc.Store.MaxSessions {
+		return errors.New("store.maxUnauthenticatedSessions: must not exceed store.maxSessions")
+	}
+	if rc.Shutdown.DrainTimeoutInSeconds < 0 {
+		return errors.New("shutdown.drainTimeoutInSeconds: must not be negative")
+	}
+	if rc.Shutdown.SnapshotKeyFile != "" && rc.Shutdown.Snapshot == "" {
+		return errors.New("shutdown.snapshotKeyFile: requires shutdown.snapshot")
+	}
+	return nil
+}
+
+// loadSecrets reads every secret from its file. Trailing newlines, as left by most editors and secret mounts, are not part of the secret.
+func (rc *runnerConfig) loadSecrets() error {
+	readSecret := func(name string, path string) (string, error) {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", name, err)
+		}
+		secret := strings.TrimRight(string(raw), "\r\n")
+		if secret == "" {
+			return "", fmt.Errorf("secret %s: %s is empty", name, path)
+		}
+		return secret, nil
+	}
+	rc.secretValues = make(map[string]string, len(rc.Secrets))
+	for name, path := range rc.Secrets {
+		secret, err := readSecret(name, path)
+		if err != nil {
+			return err
+		}
+		rc.secretValues[name] = secret
+	}
+	if rc.adminToken == "" && rc.Admin.TokenFile != "" {
+		token, err := readSecret("admin token", rc.Admin.TokenFile)
+		if err != nil {
+			return err
+		}
+		rc.adminToken = token
+	}
+	if rc.Shutdown.SnapshotKeyFile != "" {
+		encoded, err := readSecret("snapshot key", rc.Shutdown.SnapshotKeyFile)
+		if err != nil {
+			return err
+		}
+		for _, decode := range []func(string) ([]byte, error){hex.DecodeString, base64.StdEncoding.DecodeString} { //Hex first, as a hex key is also valid base64
+			if key, err := decode(encoded); err == nil && (len(key) == 16 || len(key) == 24 || len(key) == 32) {
+				rc.snapshotKey = key
+				break
+			}
+		}
+		if rc.snapshotKey == nil {
+			return errors.New("secret snapshot key: expected 16, 24 or 32 bytes encoded in base64 or hex")
+		}
+	}
+	if rc.Audit.FingerprintKeyFile != "" {
+		key, err := readSecret("fingerprint key", rc.Audit.FingerprintKeyFile)
+		if err != nil {
+			return err
+		}
+		if len(key) < 16 {
+			return errors.New("secret fingerprint key: expected at least 16 bytes")
+		}
+		rc.fingerprintKey = []byte(key)
+	}
+	return nil
+}
+
+func (rc *runnerConfig) drainTimeout() time.Duration {
+	if rc.Shutdown.DrainTimeoutInSeconds == 0 {
+		return defaultDrainTimeout
+	}
+	return time.Duration(rc.Shutdown.DrainTimeoutInSeconds) * time.Second
+}
+
+// configure applies the settings which can change while serving to the instance
+func (rc *runnerConfig) configure(i *session.Instance) error {
+	return i.ApplySettings(session.Settings{
+		LogLevel:                   rc.logLevel,
+		RouteDefaults:              rc.Defaults,
+		Secrets:                    rc.secretValues,
+		AdminToken:                 rc.adminToken,
+		MaxSessions:                rc.Store.MaxSessions,
+		MaxUnauthenticatedSessions: rc.Store.MaxUnauthenticatedSessions,
+	})
+}
+
+// restartRequired lists the settings which differ in next but are only read at start
+func (rc *runnerConfig) restartRequired(next *runnerConfig) []string {
+	var changed []string
+	check := func(name string, before, after string) {
+		if before != after {
+			changed = append(changed, name)
+		}
+	}
+	check("log.format", rc.Log.Format, next.Log.Format)
+	check("metrics.addr", rc.Metrics.Addr, next.Metrics.Addr)
+	check("admin.addr", rc.Admin.Addr, next.Admin.Addr)
+	check("audit.output", rc.Audit.Output, next.Audit.Output)
+	check("audit.fingerprintKeyFile", rc.Audit.FingerprintKeyFile, next.Audit.FingerprintKeyFile)
+	return changed
+}
+
+// secretFiles are the files the settings are read from besides the config file itself
+func (rc *runnerConfig) secretFiles() []string {
+	files := make([]string, 0, len(rc.Secrets)+1)
+	for _, path := range rc.Secrets {
+		files = append(files, path)
+	}
+	if rc.Admin.TokenFile != "" {
+		files = append(files, rc.Admin.TokenFile)
+	}
+	if rc.Shutdown.SnapshotKeyFile != "" {
+		files = append(files, rc.Shutdown.SnapshotKeyFile)
+	}
+	return files
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLoadRunnerConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	apiKey := write("api-key", "auth-one\n")
+	adminToken := write("admin-token", "admin-secret\n")
+	empty := write("empty", "\n")
+	snapshotKey := write("snapshot-key", strings.Repeat("ab", 32)+"\n")
+	shortKey := write("short-key", "c2hvcnQ=\n")
+	fingerprintKey := write("fingerprint-key", "a-fingerprint-key-of-the-runner\n")
+
+	type testCase struct {
+		name        string
+		description string
+		config      string
+		env         map[string]string
+		err         string //Expected substring of the error, empty when the config is valid
+		check       func(rc *runnerConfig) error
+	}
+	testCases := []testCase{
+		{
+			name:        "TestDefaults",
+			description: "Without a config file the runner should log at info in the console format",
+			check: func(rc *runnerConfig) error {
+				if rc.logLevel != zapcore.InfoLevel || rc.Log.Format != "console" {
+					return fmt.Errorf("unexpected defaults: %+v", rc)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestFile",
+			description: "Settings and secrets should be read from the file",
+			config:      `{"log":{"level":"warn","format":"json"},"secrets":{"api":"` + apiKey + `"},"admin":{"addr":"127.0.0.1:9096","tokenFile":"` + adminToken + `"}}`,
+			check: func(rc *runnerConfig) error {
+				if rc.logLevel != zapcore.WarnLevel || rc.Log.Format != "json" {
+					return fmt.Errorf("log settings not read: %+v", rc.Log)
+				}
+				if rc.secretValues["api"] != "auth-one" || rc.adminToken != "admin-secret" {
+					return fmt.Errorf("secrets not read or not trimmed: %q, %q", rc.secretValues["api"], rc.adminToken)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestEnvOverrides",
+			description: "Environment variables should win over the file",
+			config:      `{"log":{"level":"warn"},"metrics":{"addr":":9095"},"admin":{"tokenFile":"` + adminToken + `"}}`,
+			env:         map[string]string{logLevelEnv: "debug", metricsAddrEnv: ":9999", adminTokenEnv: "from-env"},
+			check: func(rc *runnerConfig) error {
+				if rc.logLevel != zapcore.DebugLevel || rc.Metrics.Addr != ":9999" || rc.adminToken != "from-env" {
+					return fmt.Errorf("environment not applied: %+v", rc)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestSnapshotKey",
+			description: "The snapshot key should be decoded from the key file",
+			config:      `{"shutdown":{"snapshot":"` + filepath.Join(dir, "sessions.snapshot") + `","snapshotKeyFile":"` + snapshotKey + `"}}`,
+			check: func(rc *runnerConfig) error {
+				if len(rc.snapshotKey) != 32 || rc.snapshotKey[0] != 0xab || rc.drainTimeout() != defaultDrainTimeout {
+					return fmt.Errorf("snapshot settings not read: %x, %s", rc.snapshotKey, rc.drainTimeout())
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestShortSnapshotKey",
+			description: "Snapshot keys should be AES keys",
+			config:      `{"shutdown":{"snapshot":"` + filepath.Join(dir, "sessions.snapshot") + `","snapshotKeyFile":"` + shortKey + `"}}`,
+			err:         "expected 16, 24 or 32 bytes",
+		},
+		{
+			name:        "TestFingerprintKey",
+			description: "The fingerprint key should be read from the key file",
+			config:      `{"audit":{"fingerprintKeyFile":"` + fingerprintKey + `"}}`,
+			check: func(rc *runnerConfig) error {
+				if string(rc.fingerprintKey) != "a-fingerprint-key-of-the-runner" {
+					return fmt.Errorf("fingerprint key not read: %q", rc.fingerprintKey)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestShortFingerprintKey",
+			description: "Fingerprint keys should not be guessable",
+			config:      `{"audit":{"fingerprintKeyFile":"` + shortKey + `"}}`,
+			err:         "at least 16 bytes",
+		},
+		{
+			name:        "TestStoreLimits",
+			description: "Store limits should be read from the file",
+			config:      `{"store":{"maxSessions":10000,"maxUnauthenticatedSessions":1000}}`,
+			check: func(rc *runnerConfig) error {
+				if rc.Store.MaxSessions != 10000 || rc.Store.MaxUnauthenticatedSessions != 1000 {
+					return fmt.Errorf("store limits not read: %+v", rc.Store)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestUnauthenticatedLimitAboveLimit",
+			description: "The limit of unauthenticated sessions should be the lower one",
+			config:      `{"store":{"maxSessions":100,"maxUnauthenticatedSessions":1000}}`,
+			err:         "must not exceed store.maxSessions",
+		},
+		{
+			name:        "TestUnknownField",
+			description: "Typos in the file should be reported",
+			config:      `{"logs":{"level":"warn"}}`,
+			err:         `unknown field "logs"`,
+		},
+		{
+			name:        "TestBadLevel",
+			description: "Log levels should be one of zap's",
+			config:      `{"log":{"level":"loud"}}`,
+			err:         "log.level",
+		},
+		{
+			name:        "TestUnknownField",
+			description: "Settings the runner does not know, e.g. a store backend, should be rejected rather than ignored",
+			config:      `{"store":{"backend":"redis"}}`,
+			err:         `unknown field "backend"`,
+		},
+		{
+			name:        "TestMissingSecret",
+			description: "A secret file which cannot be read should fail the start rather than disable the auth",
+			config:      `{"secrets":{"api":"` + filepath.Join(dir, "missing") + `"}}`,
+			err:         "secret api",
+		},
+		{
+			name:        "TestEmptySecret",
+			description: "An empty secret file should be rejected",
+			config:      `{"secrets":{"api":"` + empty + `"}}`,
+			err:         "is empty",
+		},
+	}
+
+	for _, tt := range testCases {
+		for _, env := range []string{logLevelEnv, logFormatEnv, metricsAddrEnv, adminAddrEnv, adminTokenEnv, adminTokenFileEnv, auditLogEnv, snapshotEnv, snapshotKeyEnv, fingerprintKeyEnv} {
+			t.Setenv(env, tt.env[env]) //Empty values do not override anything
+		}
+		path := ""
+		if tt.config != "" {
+			path = write("runner.json", tt.config)
+		}
+		rc, err := loadRunnerConfig(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%s: %s: expected error containing %q, found %v", tt.name, tt.description, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s: %s", tt.name, tt.description, err.Error())
+		}
+		if err := tt.check(rc); err != nil {
+			t.Fatalf("%s: %s: %s", tt.name, tt.description, err.Error())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const reasonRevoked = "revoked"
+
+// sessionView is what the admin API exposes of a session. Stored API keys are replaced by their fingerprint.
+type sessionView struct {
+	ID        string     `json:"id"`
+	Identity  string     `json:"identity,omitempty"` //Fingerprint of the API key stored in the session, as in the audit log
+	Cohort    string     `json:"cohort,omitempty"`
+	Upstream  string     `json:"upstream,omitempty"`
+	Breaker   string     `json:"breaker"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastSeen  time.Time  `json:"lastSeen"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (i *Instance) newSessionView(s *session) sessionView {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	v := sessionView{
+		ID:        s.sessionID,
+		Identity:  i.identity(s),
+		Cohort:    s.cohort,
+		Upstream:  s.upstream,
+		Breaker:   s.breaker.String(),
+		CreatedAt: s.createdAt,
+		LastSeen:  s.lastSeen,
+	}
+	if !s.expiresAt.IsZero() {
+		expiresAt := s.expiresAt
+		v.ExpiresAt = &expiresAt
+	}
+	return v
+}
+
+// identity is the fingerprint of the API key the session was authenticated with, if any. The caller must hold s.mx.
+func (i *Instance) identity(s *session) string {
+	if s.customKeyValue != "" {
+		return i.fingerprint(s.customKeyValue)
+	}
+	if s.apiKeyValue != "" {
+		return i.fingerprint(s.apiKeyValue)
+	}
+	return ""
+}
+
+func (i *Instance) listSessions() []*session {
+	sessions := i.store.sessions()
+	sort.Slice(sessions, func(a, b int) bool {
+		return sessions[a].createdAt.Before(sessions[b].createdAt)
+	})
+	return sessions
+}
+
+// AdminHandler serves the admin API. Every request must carry "Authorization: Bearer <token>".
+//
+//	GET    /sessions?identity=<fingerprint>&q=<id prefix>  list sessions, optionally filtered
+//	GET    /sessions/<id>                                  get one session
+//	DELETE /sessions/<id>                                  revoke one session
+//	DELETE /sessions?identity=<fingerprint>                revoke all sessions of an identity
+//	DELETE /sessions?all=true                              revoke every session
+func (i *Instance) AdminHandler(token string) http.Handler {
+	return i.adminHandler(func() string { return token })
+}
+
+// adminHandler checks requests against the token returned by token at the time of the request, so that the token can be rotated
+func (i *Instance) adminHandler(token func() string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", i.handleSessions)
+	mux.HandleFunc("/sessions/", i.handleSession)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		presented := strings.TrimPrefix(authorization, "Bearer ")
+		expected := token()
+		if presented == authorization || expected == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (i *Instance) handleSessions(w http.ResponseWriter, r *http.Request) {
+	identity := r.URL.Query().Get("identity")
+	switch r.Method {
+	case http.MethodGet:
+		prefix := r.URL.Query().Get("q")
+		views := []sessionView{}
+		for _, s := range i.listSessions() {
+			if v := i.newSessionView(s); (identity == "" || v.Identity == identity) && strings.HasPrefix(v.ID, prefix) {
+				views = append(views, v)
+			}
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"sessions": views})
+	case http.MethodDelete:
+		all := r.URL.Query().Get("all") == "true"
+		if identity == "" && !all {
+			writeAdminError(w, http.StatusBadRequest, "either identity or all=true is required")
+			return
+		}
+		removed := 0
+		for _, s := range i.listSessions() {
+			if all || i.newSessionView(s).Identity == identity {
+				if i.removeSession(s.sessionID, reasonRevoked) { //Unless it expired or was revoked since it was listed
+					removed++
+				}
+			}
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"removed": removed})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (i *Instance) handleSession(w http.ResponseWriter, r *http.Request) {
+	s := i.getSession(strings.TrimPrefix(r.URL.Path, "/sessions/"))
+	if s == nil {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, i.newSessionView(s))
+	case http.MethodDelete:
+		if !i.removeSession(s.sessionID, reasonRevoked) {
+			writeAdminError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"removed": 1})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
+
+// listenAdmin listens on a unix socket ("unix:/path/to/sock") or on a loopback TCP address. Anything else is refused since
+// the admin API exposes every session.
+func listenAdmin(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin API must listen on a unix socket or a loopback address, got %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// removeStaleSocket removes the socket left behind at path by an earlier run. Anything else at path is left alone, as the path is
+// operator supplied and may name a file or directory by mistake.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("admin socket %s: refusing to replace something which is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// ServeAdmin starts the admin API on addr, see AdminHandler and listenAdmin. Requests are checked against the admin token of the current Settings.
+// It blocks until the listener fails.
+func (i *Instance) ServeAdmin(addr string) error {
+	if i.currentAdminToken() == "" {
+		return errors.New("admin API requires a token")
+	}
+	l, err := listenAdmin(addr)
+	if err != nil {
+		return err
+	}
+	i.log.Info("Serving admin API on ", addr)
+	return http.Serve(l, i.adminHandler(i.currentAdminToken))
+}
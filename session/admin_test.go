@@ -0,0 +1,186 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestAdminAPI(t *testing.T) {
+	fingerprintKey := WithFingerprintKey([]byte("admin-test-key"))
+	fingerprint := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, fingerprintKey).fingerprint
+	type testCase struct {
+		name        string
+		description string
+		method      string
+		path        string
+		token       string
+		status      int
+		check       func(body map[string]interface{}, i *Instance) error
+	}
+	testCases := []testCase{
+		{
+			name:        "TestUnauthorized",
+			description: "Requests without the admin token should be rejected",
+			method:      http.MethodGet,
+			path:        "/sessions",
+			token:       "wrong",
+			status:      http.StatusUnauthorized,
+		},
+		{
+			name:        "TestListByIdentity",
+			description: "Sessions should be searchable by the fingerprint of their API key, which is the only form in which the key is exposed",
+			method:      http.MethodGet,
+			path:        "/sessions?identity=" + fingerprint("auth-one"),
+			token:       "admin",
+			status:      http.StatusOK,
+			check: func(body map[string]interface{}, i *Instance) error {
+				sessions := body["sessions"].([]interface{})
+				if len(sessions) != 2 {
+					return fmt.Errorf("expected 2 sessions, found %d", len(sessions))
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestGetSession",
+			description: "A single session should be returned with its key masked",
+			method:      http.MethodGet,
+			path:        "/sessions/c",
+			token:       "admin",
+			status:      http.StatusOK,
+			check: func(body map[string]interface{}, i *Instance) error {
+				if body["id"] != "c" || body["identity"] != fingerprint("auth-two") {
+					return fmt.Errorf("unexpected session: %v", body)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestDeleteSession",
+			description: "Deleting a session should remove it from the store",
+			method:      http.MethodDelete,
+			path:        "/sessions/a",
+			token:       "admin",
+			status:      http.StatusOK,
+			check: func(body map[string]interface{}, i *Instance) error {
+				if i.getSession("a") != nil {
+					return fmt.Errorf("session a still exists")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestDeleteByIdentity",
+			description: "Deleting by identity should only remove the sessions of that identity",
+			method:      http.MethodDelete,
+			path:        "/sessions?identity=" + fingerprint("auth-one"),
+			token:       "admin",
+			status:      http.StatusOK,
+			check: func(body map[string]interface{}, i *Instance) error {
+				if body["removed"] != float64(2) || i.getSession("c") == nil {
+					return fmt.Errorf("expected only the 2 sessions of auth-one to be removed: %v", body)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestFlushRequiresAll",
+			description: "Flushing every session should require an explicit all=true",
+			method:      http.MethodDelete,
+			path:        "/sessions",
+			token:       "admin",
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "TestFlush",
+			description: "all=true should remove every session",
+			method:      http.MethodDelete,
+			path:        "/sessions?all=true",
+			token:       "admin",
+			status:      http.StatusOK,
+			check: func(body map[string]interface{}, i *Instance) error {
+				if len(i.listSessions()) != 0 {
+					return fmt.Errorf("expected no sessions left")
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, fingerprintKey)
+		seed(i, map[string]*session{
+			"a": {sessionID: "a", customKeyValue: "auth-one"},
+			"b": {sessionID: "b", customKeyValue: "auth-one"},
+			"c": {sessionID: "c", customKeyValue: "auth-two"},
+		}, nil)
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		i.AdminHandler("admin").ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:expected status %d, found %d\n", tt.name, tt.description, tt.status, rec.Code))
+		}
+		if tt.check == nil {
+			continue
+		}
+		body := make(map[string]interface{})
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.check(body, i); err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+	}
+}
+
+func TestAdminBearerRequired(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	for authorization, status := range map[string]int{"Bearer admin": http.StatusOK, "admin": http.StatusUnauthorized, "Basic admin": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		i.AdminHandler("admin").ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Fatalf("expected status %d for %q, found %d", status, authorization, rec.Code)
+		}
+	}
+}
+
+func TestListenAdminSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	for n := 0; n < 2; n++ { //The socket left behind by the first listener is replaced by the second
+		l, err := listenAdmin("unix:" + path)
+		if err != nil {
+			t.Fatalf("expected to listen on %s, found %v", path, err)
+		}
+		if n == 0 {
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+	misconfigured := filepath.Join(dir, "data")
+	if err := os.Mkdir(misconfigured, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(misconfigured, "keep"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAdmin("unix:" + misconfigured); err == nil {
+		t.Fatal("expected a directory at the socket path to be refused")
+	}
+	if _, err := os.Stat(filepath.Join(misconfigured, "keep")); err != nil {
+		t.Fatalf("expected the directory to be left alone, found %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Security relevant events written to the audit stream
+const (
+	auditSessionCreated       = "session_created"
+	auditSessionAuthenticated = "session_authenticated"
+	auditSessionKeyChanged    = "session_key_changed"
+	auditSessionRejected      = "session_rejected"
+	auditSessionRotated       = "session_rotated" //A client presented a session which no longer exists and got a new one
+	auditSessionCSRFRejected  = "session_csrf_rejected"
+	auditSessionDestroyed     = "session_destroyed"
+)
+
+// newAuditLogger writes one JSON object per event. Unlike the plugin logger it has no level filtering, caller or stacktraces.
+func newAuditLogger(out zapcore.WriteSyncer) *zap.Logger {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "time"
+	encoderCfg.MessageKey = "event"
+	encoderCfg.LevelKey = ""
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), out, zapcore.InfoLevel)
+	return zap.New(core)
+}
+
+// WithAuditOutput enables the audit stream and writes it to out
+func WithAuditOutput(out zapcore.WriteSyncer) Option {
+	return func(i *Instance) {
+		i.auditLog = newAuditLogger(out)
+	}
+}
+
+// OpenAuditSink opens the sink of the audit stream, which is either "stdout", "stderr" or the path of a file to append to
+func OpenAuditSink(target string) (zapcore.WriteSyncer, error) {
+	switch target {
+	case "stdout":
+		return zapcore.Lock(os.Stdout), nil
+	case "stderr":
+		return zapcore.Lock(os.Stderr), nil
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", target, err)
+	}
+	return zapcore.Lock(f), nil
+}
+
+// WithFingerprintKey sets the key fingerprints are computed with. Without it, every start draws a random key, so that fingerprints
+// cannot be matched across restarts or runners.
+func WithFingerprintKey(key []byte) Option {
+	return func(i *Instance) {
+		if len(key) > 0 {
+			i.fingerprintKey = key
+		}
+	}
+}
+
+// randomFingerprintKey is the key of instances created without WithFingerprintKey
+func randomFingerprintKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return key
+}
+
+// fingerprint identifies a secret (session ID, API key) in traces and logs without leaking it. It is an HMAC rather than a plain hash,
+// so that low-entropy API keys cannot be recovered by hashing guesses and fingerprints of different deployments do not match.
+func (i *Instance) fingerprint(secret string) string {
+	mac := hmac.New(sha256.New, i.fingerprintKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// audit writes an event about sess to the audit stream. Secrets must only ever be passed through fingerprint.
+func (i *Instance) audit(event string, sess *session, srcIP net.IP, fields ...zap.Field) {
+	fields = append(fields, zap.String("session", i.fingerprint(sess.sessionID)))
+	if srcIP != nil {
+		fields = append(fields, zap.String("source_ip", srcIP.String()))
+	}
+	i.auditLog.Info(event, fields...)
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"math"
+	"time"
+)
+
+// CircuitBreaker replaces the removal of a session on a tripped failure policy with a cool-down, during which requests of that session are short-circuited.
+type CircuitBreaker struct {
+	CoolDownInSeconds int `json:"coolDownInSeconds"` //Time for which an open breaker rejects requests before letting a probe through
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerState is the per session state of the circuit breaker
+type breakerState struct {
+	state          int
+	openedAt       time.Time
+	probeStartedAt time.Time
+	probe          uint32 //Request ID of the probe let through when the breaker became half-open
+}
+
+func (b breakerState) String() string {
+	switch b.state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+func (c CircuitBreaker) coolDown() time.Duration {
+	return time.Duration(c.CoolDownInSeconds) * time.Second
+}
+
+func (b *breakerState) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+}
+
+func (b *breakerState) close() {
+	b.state = breakerClosed
+}
+
+// allow reports whether a request may go through to the upstream. Once the cool-down is over, a single probe request is let through and the breaker
+// becomes half-open. If the response of the probe never comes back (e.g. another plugin answered the request), another probe is allowed after one more cool-down.
+// reqID is the ID of the request asking to go through, which is remembered as the probe.
+func (b *breakerState) allow(c CircuitBreaker, now time.Time, reqID uint32) bool {
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < c.coolDown() {
+			return false
+		}
+	case breakerHalfOpen:
+		if now.Sub(b.probeStartedAt) < c.coolDown() {
+			return false
+		}
+	default:
+		return true
+	}
+	b.state = breakerHalfOpen
+	b.probeStartedAt = now
+	b.probe = reqID
+	return true
+}
+
+// isProbe reports whether reqID is the probe of a half-open breaker, whose response alone closes or re-opens it
+func (b *breakerState) isProbe(reqID uint32) bool {
+	return b.state == breakerHalfOpen && b.probe == reqID
+}
+
+// retryAfter is the number of seconds a rejected client should wait before retrying, as sent in the Retry-After header
+func (b *breakerState) retryAfter(c CircuitBreaker, now time.Time) int {
+	since := b.openedAt
+	if b.state == breakerHalfOpen {
+		since = b.probeStartedAt
+	}
+	remaining := c.coolDown() - now.Sub(since)
+	if remaining <= 0 {
+		return 0
+	}
+	return int(math.Ceil(remaining.Seconds()))
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+)
+
+const defaultCohortHeader = "X-Session-Cohort"
+
+// cohortRand draws the cohorts. The global source of math/rand is not seeded before go1.20, so every runner would draw the same sequence.
+var cohortRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func (c Config) cohortHeader() string {
+	if c.CohortHeader != "" {
+		return c.CohortHeader
+	}
+	return defaultCohortHeader
+}
+
+// pickCohort draws a cohort with a probability proportional to its weight. Names are sorted so the draw only depends on the random number.
+func pickCohort(cohorts map[string]int) string {
+	names := make([]string, 0, len(cohorts))
+	total := 0
+	for name, weight := range cohorts {
+		if weight > 0 {
+			names = append(names, name)
+			total += weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	cohortRand.Lock()
+	n := cohortRand.Intn(total)
+	cohortRand.Unlock()
+	for _, name := range names {
+		n -= cohorts[name]
+		if n < 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// assignCohort gives the session a cohort unless it already has one that is still configured for the route, so that the assignment stays
+// stable for the lifetime of the session.
+func assignCohort(config Config, sess *session) {
+	if _, ok := config.Cohorts[sess.cohort]; ok && sess.cohort != "" {
+		return
+	}
+	sess.cohort = pickCohort(config.Cohorts)
+}
+
+// setCohort exposes the cohort of the session to APISIX (e.g. for traffic-split) as a request header and optionally as a request cookie.
+// Values sent by the client are always replaced so that clients cannot pick their own cohort.
+func setCohort(config Config, sess *session, r apisixHTTP.Request) {
+	r.Header().Set(config.cohortHeader(), sess.cohort)
+	if config.CohortCookie != "" {
+		r.Header().Set("Cookie", setCookieValue(requestCookies(r.Header()), config.CohortCookie, sess.cohort))
+	}
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// setDefaults fills in everything a route config leaves out, so that the parsed config spells out the effective behaviour
+func (c *Config) setDefaults() {
+	if c.FailurePolicy == nil && c.SessionTimeoutOnFailedRequests > 0 {
+		c.FailurePolicy = &FailurePolicy{Limit: c.SessionTimeoutOnFailedRequests}
+	}
+	if p := c.FailurePolicy; p != nil {
+		if p.Mode == "" {
+			p.Mode = failureModeTotal
+		}
+		if len(p.StatusCodes) == 0 && len(p.StatusClasses) == 0 {
+			p.StatusClasses = []int{4, 5}
+		}
+	}
+	if c.StickyUpstream {
+		c.UpstreamHintHeader = c.upstreamHintHeader()
+		c.StickyFailureLimit = c.stickyFailureLimit()
+	}
+	if len(c.Cohorts) > 0 {
+		c.CohortHeader = c.cohortHeader()
+	}
+	c.Transport = c.transport()
+	if c.Transport == transportHeader {
+		c.TokenHeader = c.tokenHeader()
+	}
+	c.CreateOn = c.createOn()
+	if c.CreateOn == createOnUpstream {
+		c.CreateHeader = c.createHeader()
+	}
+	if c.CSRF {
+		c.CSRFHeader = c.csrfHeader()
+		if c.Transport == transportCookie {
+			c.CSRFCookie = c.csrfCookie()
+		}
+	}
+}
+
+// validate checks what the schema cannot express, i.e. constraints across fields
+func (c Config) validate() error {
+	if c.KeyAuthEnabled && c.customKeyAuthEnabled() {
+		return errors.New("keyAuthEnabled and customKeyAuth cannot be used together, as both read the key from the same header")
+	}
+	if c.CustomKeyAuth != "" && c.CustomKeyAuthSecret != "" {
+		return errors.New("customKeyAuth and customKeyAuthSecret cannot be used together")
+	}
+	if c.FailurePolicy != nil && c.SessionTimeoutOnFailedRequests > 0 && c.FailurePolicy.Limit != c.SessionTimeoutOnFailedRequests {
+		return errors.New("failureLimit and failurePolicy.limit disagree, use only failurePolicy")
+	}
+	if c.CircuitBreaker != nil && c.failurePolicy().Limit == 0 {
+		return errors.New("circuitBreaker requires failureLimit or failurePolicy.limit to be set")
+	}
+	if len(c.Cohorts) > 0 {
+		total := 0
+		for _, weight := range c.Cohorts {
+			total += weight
+		}
+		if total == 0 {
+			return errors.New("cohorts: at least one cohort needs a positive weight")
+		}
+	}
+	if c.createOn() == createOnAuth && !c.KeyAuthEnabled && !c.customKeyAuthEnabled() {
+		return errors.New("createOn auth requires keyAuthEnabled, customKeyAuth or customKeyAuthSecret")
+	}
+	if c.createOn() == createOnWrite && !c.StickyUpstream && !c.KeyAuthEnabled && !c.customKeyAuthEnabled() && len(c.Cohorts) == 0 {
+		return errors.New("createOn write requires an API key, cohorts or stickyUpstream to write")
+	}
+	if c.CohortCookie != "" && c.CohortCookie == c.CookieName {
+		return fmt.Errorf("cohortCookie: %q is already the session cookie", c.CohortCookie)
+	}
+	if c.CSRF && c.transport() == transportCookie && (isChunk(c.csrfCookie(), c.CookieName) || c.csrfCookie() == c.CohortCookie) {
+		return fmt.Errorf("csrfCookie: %q is already the session or cohort cookie", c.csrfCookie())
+	}
+	return nil
+}
+
+// Fingerprint identifies the effective config, so that the configs passed to ext-plugin-pre-req and ext-plugin-post-resp can be compared.
+// ParseConf computes it once, configs built otherwise get it computed on every call. The custom key is left out, as the fingerprint is
+// logged and a short unsalted hash over the key would help guessing it. Only RequestFilter checks the key, so a mismatch in it is harmless.
+func (c Config) Fingerprint() string {
+	if c.fingerprint != "" {
+		return c.fingerprint
+	}
+	if c.CustomKeyAuth != "" {
+		c.CustomKeyAuth = "set"
+	}
+	raw, _ := json.Marshal(c) //Struct fields are marshalled in order and map keys sorted, so equal configs give equal output
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
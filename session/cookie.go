@@ -0,0 +1,175 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+)
+
+// requestCookies returns every Cookie header of the request. HTTP/2 clients may send each cookie in a header of its own (RFC 9113 8.2.3).
+func requestCookies(h apisixHTTP.Header) []string {
+	return h.View().Values("Cookie")
+}
+
+// cookieValues returns the value of every cookie called name in the Cookie headers, in the order the client sent them.
+// Parsing follows net/http: pairs may be separated by ";" with or without spaces, quoted values are unquoted, and malformed pairs are skipped.
+// Whitespace around values is dropped as in RFC 6265 5.2.
+func cookieValues(headers []string, name string) []string {
+	req := http.Request{Header: http.Header{"Cookie": headers}}
+	var values []string
+	for _, c := range req.Cookies() {
+		if value := strings.TrimSpace(c.Value); c.Name == name && value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Browsers keep cookies of up to 4096 bytes, name and attributes included. Longer values are split over several cookies of this size.
+const cookieChunkSize = 4000
+
+// chunkName returns the name of the n-th chunk of the cookie called name: name itself, then name_1, name_2 and so on
+func chunkName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s_%d", name, n)
+}
+
+// isChunk reports whether cookieName names the cookie called name or one of its chunks
+func isChunk(cookieName string, name string) bool {
+	if cookieName == name {
+		return true
+	}
+	if !strings.HasPrefix(cookieName, name+"_") {
+		return false
+	}
+	suffix := strings.TrimPrefix(cookieName, name+"_")
+	n, err := strconv.Atoi(suffix)
+	return err == nil && n > 0 && strconv.Itoa(n) == suffix
+}
+
+// chunkedCookieValues returns the values of the cookie called name like cookieValues, with a value split by splitCookie put back together
+// from the chunks up to the first missing or short one. Only a value filling its first chunk can have been split, so stray chunks next to
+// shorter values are ignored. Chunks cannot be told apart between duplicate cookies, so only the first split value is put together, ahead
+// of the other values which are kept as they are. chunks is the number of cookies the value was read from, 0 when there is none.
+func chunkedCookieValues(headers []string, name string) (values []string, chunks int) {
+	values = cookieValues(headers, name)
+	if len(values) == 0 {
+		return nil, 0
+	}
+	for n, value := range values {
+		if len(value) != cookieChunkSize {
+			continue
+		}
+		for chunks = 1; len(value) == chunks*cookieChunkSize; chunks++ {
+			chunk := cookieValues(headers, chunkName(name, chunks))
+			if len(chunk) == 0 {
+				break
+			}
+			value += chunk[0]
+		}
+		return append([]string{value}, append(values[:n:n], values[n+1:]...)...), chunks
+	}
+	return values, 1
+}
+
+// splitCookie returns the Set-Cookie values storing value in the cookie called name, split into chunks of cookieChunkSize.
+// Chunks beyond the new ones of the staleChunks the client holds are expired, so that they are not read back as part of the value.
+func splitCookie(name string, value string, staleChunks int) []string {
+	var cookies []string
+	for n := 0; n == 0 || value != ""; n++ {
+		size := cookieChunkSize
+		if len(value) < size {
+			size = len(value)
+		}
+		cookies = append(cookies, fmt.Sprintf("%s=%s", chunkName(name, n), value[:size]))
+		value = value[size:]
+	}
+	for n := len(cookies); n < staleChunks; n++ {
+		cookies = append(cookies, fmt.Sprintf("%s=; Max-Age=0", chunkName(name, n)))
+	}
+	return cookies
+}
+
+// withoutCookie returns the cookie pairs of headers except the cookies called name and their chunks. The pairs are kept as they are.
+func withoutCookie(headers []string, name string) []string {
+	var pairs []string
+	for _, header := range headers {
+		for _, pair := range strings.Split(header, ";") {
+			pair = strings.TrimSpace(pair)
+			pairName, _, _ := strings.Cut(pair, "=")
+			if pair == "" || isChunk(strings.TrimSpace(pairName), name) {
+				continue
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// setCookieValue returns a single Cookie header holding the cookies of headers with every cookie called name replaced by one set to value,
+// split into chunks as the client would send them. Other cookies are kept as they are. Only the first Cookie header of a request is passed
+// back to APISIX, hence the single header.
+func setCookieValue(headers []string, name string, value string) string {
+	return strings.Join(append(withoutCookie(headers, name), splitCookie(name, value, 0)...), "; ")
+}
+
+// appendSetCookie adds cookies to the Set-Cookie headers of the upstream response, replacing cookies the upstream set under name or
+// the name of one of its chunks. The runner passes only the first value of a header back to APISIX, which sets the values of all headers
+// whose names only differ in case together. So unless there is a single value, every value, the upstream's included, is passed under a
+// casing of its own. Cookies appended before are kept, so that several cookies can be appended to the same response.
+func appendSetCookie(h apisixHTTP.Header, name string, cookies []string) {
+	view := h.View()
+	values := append([]string(nil), view.Values("Set-Cookie")...)
+	for n := 0; len(view[setCookieCasing(n)]) > 0; n++ { //Appended before
+		values = append(values, view[setCookieCasing(n)][0])
+		delete(view, setCookieCasing(n))
+	}
+	var kept []string
+	for _, value := range values {
+		if valueName, _, _ := strings.Cut(value, "="); !isChunk(strings.TrimSpace(valueName), name) {
+			kept = append(kept, value)
+		}
+	}
+	if len(kept) == 0 && len(cookies) == 1 {
+		h.Set("Set-Cookie", cookies[0])
+		return
+	}
+	h.Del("Set-Cookie") //Its values go under the casings, APISIX replaces all Set-Cookie headers with them
+	for n, value := range append(kept, cookies...) {
+		view[setCookieCasing(n)] = []string{value}
+	}
+}
+
+// setCookieCasing returns the n-th casing of Set-Cookie, leaving out the canonical one which appendSetCookie drops once it uses the casings.
+// The bits of n pick the letters in upper case, so there are 511 of them.
+func setCookieCasing(n int) string {
+	const canonical = 1<<0 | 1<<3 //S and C
+	if n >= canonical {
+		n++
+	}
+	var name strings.Builder
+	for i, c := range "setcookie" {
+		if i == 3 {
+			name.WriteByte('-')
+		}
+		if n&(1<<i) != 0 {
+			c -= 'a' - 'A'
+		}
+		name.WriteRune(c)
+	}
+	return name.String()
+}
+
+// removeCookie drops every cookie called name from the request, keeping the other cookies
+func removeCookie(h apisixHTTP.Header, name string) {
+	if pairs := withoutCookie(requestCookies(h), name); len(pairs) > 0 {
+		h.Set("Cookie", strings.Join(pairs, "; "))
+	} else {
+		h.Del("Cookie")
+	}
+}
@@ -0,0 +1,265 @@
+package session
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
+	"go.uber.org/zap/zapcore"
+)
+
+// cookieValue returns the first cookie called name in a Cookie or Set-Cookie header as set by the filters
+func cookieValue(name string, header string) (string, bool) {
+	if values := cookieValues([]string{header}, name); len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
+
+func TestCookieValues(t *testing.T) {
+	type testCase struct {
+		name        string
+		description string
+		headers     []string
+		values      []string
+	}
+	testCases := []testCase{
+		{
+			name:        "TestSingle",
+			description: "The value of the cookie should be found among others",
+			headers:     []string{"a=1; sid=abc; b=2"},
+			values:      []string{"abc"},
+		},
+		{
+			name:        "TestNoSpace",
+			description: "Pairs separated by ; without space should be split",
+			headers:     []string{"a=1;sid=abc;b=2"},
+			values:      []string{"abc"},
+		},
+		{
+			name:        "TestQuoted",
+			description: "Quoted values should be unquoted",
+			headers:     []string{`sid="abc"`},
+			values:      []string{"abc"},
+		},
+		{
+			name:        "TestPrefix",
+			description: "Cookies whose name starts with the name should not match",
+			headers:     []string{"sid2=x; xsid=y; sid=abc"},
+			values:      []string{"abc"},
+		},
+		{
+			name:        "TestWhitespace",
+			description: "Whitespace around pairs should be ignored",
+			headers:     []string{"  a=1 ;   sid = abc  "},
+			values:      []string{"abc"},
+		},
+		{
+			name:        "TestDuplicates",
+			description: "Every cookie of the name should be returned in the order sent",
+			headers:     []string{"sid=new; sid=old"},
+			values:      []string{"new", "old"},
+		},
+		{
+			name:        "TestMultipleHeaders",
+			description: "Cookies should be read from every Cookie header",
+			headers:     []string{"a=1", "sid=abc"},
+			values:      []string{"abc"},
+		},
+		{
+			name:        "TestEmptyAndMalformed",
+			description: "Empty values and malformed pairs should be skipped",
+			headers:     []string{`sid=; sid; =abc; sid=a"b; sid=" "`},
+		},
+	}
+	for _, tt := range testCases {
+		if values := cookieValues(tt.headers, "sid"); fmt.Sprint(values) != fmt.Sprint(tt.values) {
+			t.Fatalf("%s: %s: expected %v, found %v", tt.name, tt.description, tt.values, values)
+		}
+	}
+}
+
+func TestSetCookieValue(t *testing.T) {
+	header := setCookieValue([]string{`a=1;sid=old; sid2="x"`, "sid =older; b=2"}, "sid", "new")
+	if header != `a=1; sid2="x"; b=2; sid=new` {
+		t.Fatalf("expected the session cookies to be replaced and the others kept, found %q", header)
+	}
+}
+
+func TestChunkedCookieValues(t *testing.T) {
+	full, next := strings.Repeat("a", cookieChunkSize), strings.Repeat("b", cookieChunkSize) //Chunks a value was split into fill all but the last
+	type testCase struct {
+		name        string
+		description string
+		headers     []string
+		values      []string
+		chunks      int
+	}
+	testCases := []testCase{
+		{
+			name:        "TestUnchunked",
+			description: "A cookie without chunks should be read as it is",
+			headers:     []string{"sid=abc; sid=def"},
+			values:      []string{"abc", "def"},
+			chunks:      1,
+		},
+		{
+			name:        "TestChunks",
+			description: "Chunks should be put back together in order, whatever order they were sent in",
+			headers:     []string{"sid_2=ghi; sid=" + full, "a=1; sid_1=" + next},
+			values:      []string{full + next + "ghi"},
+			chunks:      3,
+		},
+		{
+			name:        "TestGap",
+			description: "Chunks after a missing one should be ignored",
+			headers:     []string{"sid=" + full + "; sid_1=" + next + "; sid_3=jkl"},
+			values:      []string{full + next},
+			chunks:      2,
+		},
+		{
+			name:        "TestShortChunk",
+			description: "Chunks after a short one should be ignored",
+			headers:     []string{"sid=" + full + "; sid_1=def; sid_2=ghi"},
+			values:      []string{full + "def"},
+			chunks:      2,
+		},
+		{
+			name:        "TestStrayChunk",
+			description: "A chunk next to values too short to have been split should leave the duplicates as they are",
+			headers:     []string{"sid=abc; sid_1=def; sid=ghi"},
+			values:      []string{"abc", "ghi"},
+			chunks:      1,
+		},
+		{
+			name:        "TestChunksAndDuplicate",
+			description: "The split value should be put together ahead of the duplicates",
+			headers:     []string{"sid=abc; sid=" + full + "; sid_1=def"},
+			values:      []string{full + "def", "abc"},
+			chunks:      2,
+		},
+		{
+			name:        "TestChunksOnly",
+			description: "Chunks without the first cookie should not make up a value",
+			headers:     []string{"sid_1=def; sid_2=ghi"},
+		},
+	}
+	for _, tt := range testCases {
+		values, chunks := chunkedCookieValues(tt.headers, "sid")
+		if fmt.Sprint(values) != fmt.Sprint(tt.values) || chunks != tt.chunks {
+			t.Fatalf("%s: %s: expected %d values in %d chunks, found %d in %d", tt.name, tt.description, len(tt.values), tt.chunks, len(values), chunks)
+		}
+	}
+}
+
+func TestSplitCookie(t *testing.T) {
+	value := strings.Repeat("x", 2*cookieChunkSize+1)
+	cookies := splitCookie("sid", value, 5)
+	if len(cookies) != 5 || cookies[3] != "sid_3=; Max-Age=0" || cookies[4] != "sid_4=; Max-Age=0" {
+		t.Fatalf("expected 3 chunks and 2 expired stale chunks, found %d cookies ending with %q", len(cookies), cookies[len(cookies)-1])
+	}
+	for _, cookie := range cookies {
+		if len(cookie) > 4096 {
+			t.Fatalf("expected every chunk to fit in a cookie, found %d bytes", len(cookie))
+		}
+	}
+	if values, chunks := chunkedCookieValues([]string{strings.Join(cookies[:3], "; ")}, "sid"); len(values) != 1 || values[0] != value || chunks != 3 {
+		t.Fatalf("expected the chunks to be read back as the value, found %d values in %d chunks", len(values), chunks)
+	}
+	if cookies := splitCookie("sid", "abc", 0); len(cookies) != 1 || cookies[0] != "sid=abc" {
+		t.Fatalf("expected a short value to be set in a single cookie, found %v", cookies)
+	}
+}
+
+func TestChunkedSetCookieValue(t *testing.T) {
+	header := setCookieValue([]string{"a=1; sid=old; sid_1=older; sid_x=2; sid_01=3"}, "sid", "new")
+	if header != "a=1; sid_x=2; sid_01=3; sid=new" {
+		t.Fatalf("expected the stale chunks to be dropped and other cookies kept, found %q", header)
+	}
+}
+
+func TestStaleChunksExpired(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := strings.Repeat("g", cookieChunkSize)
+	req := &MockRequest{id: 1, readheader: mockHeader{header: map[string]string{"Cookie": "sid=" + gone + "; sid_1=" + gone + "; sid_2=y"}}}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+	res := &MockAPISIXResponseWriter{resid: 2, statuscode: http.StatusOK, header: mockHeader{view: http.Header{"Set-Cookie": {"sid_1=upstream", "theme=dark"}}}}
+	i.ResponseFilter(cfg, res)
+	var cookies []string
+	for name, values := range res.Header().View() {
+		if strings.EqualFold(name, "Set-Cookie") && name != "Set-Cookie" { //What the runner passes back to APISIX
+			cookies = append(cookies, values...)
+		}
+	}
+	sort.Strings(cookies)
+	sid := i.store.sessions()[0].sessionID
+	if expected := []string{"sid=" + sid, "sid_1=; Max-Age=0", "sid_2=; Max-Age=0", "theme=dark"}; fmt.Sprint(cookies) != fmt.Sprint(expected) {
+		t.Fatalf("expected the new session cookie, the stale chunks expired and the upstream cookie kept, found %v", cookies)
+	}
+}
+
+func TestSetCookieCasing(t *testing.T) {
+	seen := make(map[string]bool)
+	for n := 0; n < 511; n++ {
+		name := setCookieCasing(n)
+		if seen[name] || name == "Set-Cookie" || !strings.EqualFold(name, "Set-Cookie") {
+			t.Fatalf("casing %d: %q is a duplicate, the canonical casing or not Set-Cookie", n, name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestDuplicateSessionCookies(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.addSession(&session{sessionID: "live"})
+	req := &MockRequest{id: 1, readheader: mockHeader{header: map[string]string{"Cookie": "sid=stale; other=1; sid=live"}}}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+	if n := i.store.sessionCount(); n != 1 {
+		t.Fatalf("expected the live session to be used rather than a new one, found %d sessions", n)
+	}
+	if p := i.store.request(1); p == nil || p.sess.sessionID != "live" {
+		t.Fatalf("expected the request to be mapped to the live session, found %+v", p)
+	}
+	req = &MockRequest{id: 3, readheader: mockHeader{header: map[string]string{"Cookie": "sid=stale; sid_1=stray; sid=live"}}}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+	if p := i.store.request(3); p == nil || p.sess.sessionID != "live" {
+		t.Fatalf("expected a stray chunk cookie to leave the fallback to the live session in place, found %+v", p)
+	}
+}
+
+func FuzzCookieValues(f *testing.F) {
+	for _, seed := range []string{"sid=abc", "a=1;sid=abc", `sid="abc"; sid=def`, "sid2=x; sid=", "  sid = abc ", "=;;=sid", "sid=a\x00b"} {
+		f.Add(seed, "sid")
+	}
+	f.Fuzz(func(t *testing.T, header string, name string) {
+		for _, value := range cookieValues([]string{header}, name) {
+			if value == "" || value != strings.TrimSpace(value) || strings.ContainsAny(value, ";\"") {
+				t.Fatalf("invalid value %q of %q in %q", value, name, header)
+			}
+		}
+		if !validCookieToken(name) {
+			return
+		}
+		replaced := setCookieValue([]string{header}, name, "session-id")
+		if values := cookieValues([]string{replaced}, name); len(values) != 1 || values[0] != "session-id" {
+			t.Fatalf("expected %q to hold a single %s cookie, found %v", replaced, name, values)
+		}
+	})
+}
+
+// validCookieToken reports whether net/http accepts name as a cookie name
+func validCookieToken(name string) bool {
+	return name != "" && (&http.Cookie{Name: name, Value: "v"}).Valid() == nil
+}
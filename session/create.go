@@ -0,0 +1,78 @@
+package session
+
+import (
+	"net/http"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+)
+
+// Values of Config.CreateOn, i.e. when a request without a session gets one
+const (
+	createOnAlways   = "always"   //On the first request, whether the client ever comes back or not
+	createOnAuth     = "auth"     //Once a request passes the auth
+	createOnWrite    = "write"    //Once there is something to keep for the client: an API key which passes the auth, a cohort or the upstream node to pin to
+	createOnUpstream = "upstream" //Once the upstream asks for it with the create header in its response
+)
+
+const defaultCreateHeader = "X-Session-Create"
+
+func (c Config) createOn() string {
+	if c.CreateOn != "" {
+		return c.CreateOn
+	}
+	return createOnAlways
+}
+
+func (c Config) createHeader() string {
+	if c.CreateHeader != "" {
+		return c.CreateHeader
+	}
+	return defaultCreateHeader
+}
+
+// passesAuth reports whether the request would be let through by the auth of the route. Requests with an API key count as passing key-auth,
+// as the key-auth plugin checks the key itself.
+func (i *Instance) passesAuth(config Config, r apisixHTTP.Request) bool {
+	if config.customKeyAuthEnabled() {
+		customKey := i.customKey(config)
+		return customKey != "" && r.Header().Get(CUSTOMAPIKEY) == customKey
+	}
+	return config.KeyAuthEnabled && r.Header().Get(APIKEY) != ""
+}
+
+// createOnRequest decides whether the new session sess, filled in from the request, is stored right away.
+// Sessions of the write and upstream policies which are not stored yet may still be stored by createOnResponse.
+func (i *Instance) createOnRequest(config Config, sess *session, r apisixHTTP.Request) bool {
+	switch config.createOn() {
+	case createOnAuth:
+		return i.passesAuth(config, r)
+	case createOnWrite:
+		if len(config.Cohorts) > 0 { //The cohort drawn for every new session has to be kept, or the client would switch cohorts from request to request
+			return true
+		}
+		return (sess.apiKeyValue != "" || sess.customKeyValue != "") && i.passesAuth(config, r) //A rejected key is nothing to keep
+	case createOnUpstream:
+		return false
+	default:
+		return true
+	}
+}
+
+// deferCreation reports whether the response may still create a session the request did not
+func (c Config) deferCreation() bool {
+	return c.createOn() == createOnWrite || c.createOn() == createOnUpstream
+}
+
+// createOnResponse decides whether the session deferred by the request is stored. served is the node which served the response, see servedBy.
+// The create header is not passed on to the client.
+func (i *Instance) createOnResponse(config Config, w apisixHTTP.Response, served string) bool {
+	create := false
+	switch config.createOn() {
+	case createOnWrite:
+		create = config.StickyUpstream && served != "" && w.StatusCode() < http.StatusInternalServerError
+	case createOnUpstream:
+		create = w.Header().Get(config.createHeader()) != ""
+		w.Header().Del(config.createHeader())
+	}
+	return create && !i.draining.Load() //The session would be lost with the runner
+}
@@ -0,0 +1,138 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+)
+
+const (
+	defaultCSRFHeader = "X-CSRF-Token"
+	defaultCSRFCookie = "csrf_token"
+)
+
+// Reasons for which an unsafe request is rejected with 403 when csrf is enabled
+const (
+	csrfBadOrigin = "origin" //The Origin or Referer of the request is neither the route's host nor a trusted origin
+	csrfBadToken  = "token"  //The request did not carry the CSRF token of its session
+)
+
+func (c Config) csrfHeader() string {
+	if c.CSRFHeader != "" {
+		return c.CSRFHeader
+	}
+	return defaultCSRFHeader
+}
+
+func (c Config) csrfCookie() string {
+	if c.CSRFCookie != "" {
+		return c.CSRFCookie
+	}
+	return defaultCSRFCookie
+}
+
+// unsafeMethod reports whether the method may change state on the upstream, i.e. whether a forged request of it does harm
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// newCSRFToken returns 256 random bits, unrelated to the session ID so that the token, which scripts can read, tells nothing about it
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// trustedOrigin reports whether the request comes from a page of the route's own scheme and host or of a trusted origin, going by the Origin header
+// or, when browsers leave it out, the Referer. Requests with neither, e.g. from clients which are not browsers, are left to the token check.
+func (c Config) trustedOrigin(r apisixHTTP.Request) bool {
+	origin := r.Header().Get("Origin")
+	if origin == "" {
+		referer := r.Header().Get("Referer")
+		if referer == "" {
+			return true
+		}
+		origin = referer
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" { //Including the opaque origin "null" of sandboxed pages and privacy redirects
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Header().Get("Host")) {
+		scheme, err := r.Var("scheme") //Only asked for requests claiming the route's host, it takes a round trip to APISIX
+		return err == nil && strings.EqualFold(u.Scheme, string(scheme))
+	}
+	for _, trusted := range c.CSRFTrustedOrigins {
+		if strings.EqualFold(u.Scheme+"://"+u.Host, trusted) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin returns the reason to reject an unsafe request from an untrusted origin, or "" when its origin may pass. It may ask APISIX for
+// the scheme of the request, so it is called before sess.mx is taken rather than keeping other requests of the session waiting.
+func (c Config) checkOrigin(r apisixHTTP.Request) string {
+	if !unsafeMethod(r.Method()) || c.trustedOrigin(r) {
+		return ""
+	}
+	return csrfBadOrigin
+}
+
+// checkCSRF returns the reason to reject an unsafe request made with sess, or "" when it may pass. The origin is checked by checkOrigin.
+// The caller must hold sess.mx.
+func (c Config) checkCSRF(sess *session, r apisixHTTP.Request) string {
+	if !unsafeMethod(r.Method()) {
+		return ""
+	}
+	if !validCSRFToken(sess, r.Header().Get(c.csrfHeader())) {
+		return csrfBadToken
+	}
+	return ""
+}
+
+func validCSRFToken(sess *session, token string) bool {
+	return sess.csrfToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrfToken)) == 1
+}
+
+// presentsCSRFToken reports whether the client still holds the CSRF token of sess, going by the cookie with the cookie transport and by
+// the CSRF header otherwise. The caller must hold sess.mx.
+func (c Config) presentsCSRFToken(sess *session, r apisixHTTP.Request) bool {
+	if c.transport() == transportHeader {
+		return validCSRFToken(sess, r.Header().Get(c.csrfHeader()))
+	}
+	for _, token := range cookieValues(requestCookies(r.Header()), c.csrfCookie()) {
+		if validCSRFToken(sess, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// issueCSRFToken gives sess a CSRF token, if it has none yet, and hands it to the client with the upstream response: in a cookie scripts of the
+// page can read with the cookie transport, or in the CSRF header with the header transport. A token the session already has is only handed
+// out again when resend is set. The caller must hold sess.mx.
+func (c Config) issueCSRFToken(sess *session, h apisixHTTP.Header, resend bool) {
+	if sess.csrfToken == "" {
+		sess.csrfToken = newCSRFToken()
+	} else if !resend {
+		return
+	}
+	if c.transport() == transportHeader {
+		h.Set(c.csrfHeader(), sess.csrfToken)
+		return
+	}
+	appendSetCookie(h, c.csrfCookie(), []string{fmt.Sprintf("%s=%s; Path=/; SameSite=Strict", c.csrfCookie(), sess.csrfToken)})
+}
@@ -0,0 +1,108 @@
+package session
+
+import "time"
+
+const (
+	failureModeTotal       = "total"       //Every failure counts until the session dies
+	failureModeConsecutive = "consecutive" //A successful response resets the count
+)
+
+// FailurePolicy decides which responses count as failures and when enough of them have been seen to reset the session.
+type FailurePolicy struct {
+	Limit           int    `json:"limit"`           //Number of failures after which the policy trips. 0 disables the policy
+	StatusCodes     []int  `json:"statusCodes"`     //Exact status codes counted as failures, e.g. [429, 503]
+	StatusClasses   []int  `json:"statusClasses"`   //Status classes counted as failures, e.g. [5] for all 5xx. Defaults to [4, 5] when no codes or classes are given
+	Mode            string `json:"mode"`            //"total" (default) or "consecutive"
+	WindowInSeconds int    `json:"windowInSeconds"` //Only failures seen within this sliding window count. 0 means no window
+}
+
+// failurePolicy returns the effective policy of a route. The legacy failureLimit is treated as a total count of 4xx and 5xx responses.
+func (c Config) failurePolicy() FailurePolicy {
+	if c.FailurePolicy != nil {
+		return *c.FailurePolicy
+	}
+	return FailurePolicy{Limit: c.SessionTimeoutOnFailedRequests}
+}
+
+func (p FailurePolicy) isFailure(statusCode int) bool {
+	for _, code := range p.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	for _, class := range p.StatusClasses {
+		if class == statusCode/100 {
+			return true
+		}
+	}
+	if len(p.StatusCodes) == 0 && len(p.StatusClasses) == 0 {
+		return statusCode >= 400
+	}
+	return false
+}
+
+// failureCounter counts the failures of a session. Without a window a plain count is enough. With a window, the timestamps of the failures
+// within it are kept in a ring buffer which grows as failures come in, up to Limit, so a session only holds the failures it actually had.
+type failureCounter struct {
+	failures []time.Time //Ring buffer of the failures within the window, the oldest at start
+	start    int
+	count    int //Number of failures counted, all of them held in failures when there is a window
+}
+
+// record stores the outcome of a response and reports whether the policy has tripped.
+func (f *failureCounter) record(statusCode int, p FailurePolicy, now time.Time) bool {
+	if p.Limit <= 0 {
+		return false
+	}
+	if !p.isFailure(statusCode) {
+		if p.Mode == failureModeConsecutive {
+			f.reset()
+		}
+		return false
+	}
+	if p.WindowInSeconds <= 0 {
+		f.failures = nil
+		f.count++
+		return f.count >= p.Limit
+	}
+	if f.count > len(f.failures) || len(f.failures) > p.Limit { //The policy of a route can change while the session lives
+		f.failures = nil
+		f.reset()
+	}
+	window := time.Duration(p.WindowInSeconds) * time.Second
+	for f.count > 0 && now.Sub(f.failures[f.start]) > window { //Failures which fell out of the window
+		f.start = (f.start + 1) % len(f.failures)
+		f.count--
+	}
+	if f.count == len(f.failures) {
+		if f.count < p.Limit {
+			f.grow(p.Limit)
+		} else { //The policy tripped before without the session being reset, the oldest failure makes room
+			f.start = (f.start + 1) % len(f.failures)
+			f.count--
+		}
+	}
+	f.failures[(f.start+f.count)%len(f.failures)] = now
+	f.count++
+	return f.count >= p.Limit
+}
+
+// grow doubles the ring buffer, up to limit, keeping the failures in order
+func (f *failureCounter) grow(limit int) {
+	size := 2 * len(f.failures)
+	if size == 0 {
+		size = 4
+	}
+	if size > limit {
+		size = limit
+	}
+	failures := make([]time.Time, size)
+	for n := 0; n < f.count; n++ {
+		failures[n] = f.failures[(f.start+n)%len(f.failures)]
+	}
+	f.failures, f.start = failures, 0
+}
+
+func (f *failureCounter) reset() {
+	f.start, f.count = 0, 0
+}
@@ -0,0 +1,104 @@
+package session
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons for which a session is removed, used as the reason label of the removed sessions counter
+const (
+	reasonTimeout      = "timeout"
+	reasonFailureLimit = "failure_limit"
+	reasonEvicted      = "evicted" //Least recently used session removed to stay within the limits of the store
+)
+
+// metrics are registered on a registry owned by the instance rather than the global one, so that multiple instances (as in tests) don't collide
+type metrics struct {
+	registry         *prometheus.Registry
+	sessionsCreated  prometheus.Counter
+	sessionsRemoved  *prometheus.CounterVec
+	authRejections   prometheus.Counter
+	csrfRejections   prometheus.Counter
+	filterDuration   *prometheus.HistogramVec
+	configMismatches prometheus.Counter
+}
+
+func newMetrics(i *Instance) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		sessionsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: pluginName,
+			Name:      "sessions_created_total",
+			Help:      "Number of sessions created.",
+		}),
+		sessionsRemoved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: pluginName,
+			Name:      "sessions_removed_total",
+			Help:      "Number of sessions removed, by reason.",
+		}, []string{"reason"}),
+		authRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: pluginName,
+			Name:      "auth_rejections_total",
+			Help:      "Number of requests rejected with 401 by the custom key auth.",
+		}),
+		csrfRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: pluginName,
+			Name:      "csrf_rejections_total",
+			Help:      "Number of requests rejected with 403 by the CSRF check.",
+		}),
+		configMismatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: pluginName,
+			Name:      "config_mismatches_total",
+			Help:      "Number of responses whose ext-plugin-post-resp config differs from the ext-plugin-pre-req config of their request.",
+		}),
+		filterDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: pluginName,
+			Name:      "filter_duration_seconds",
+			Help:      "Time spent in RequestFilter and ResponseFilter.",
+			Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05},
+		}, []string{"filter"}),
+	}
+	m.registry.MustRegister(
+		m.sessionsCreated,
+		m.sessionsRemoved,
+		m.authRejections,
+		m.csrfRejections,
+		m.configMismatches,
+		m.filterDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: pluginName,
+			Name:      "active_sessions",
+			Help:      "Number of sessions currently stored.",
+		}, func() float64 {
+			return float64(i.store.sessionCount())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: pluginName,
+			Name:      "pending_request_mappings",
+			Help:      "Number of request IDs currently mapped to a session.",
+		}, func() float64 {
+			return float64(i.store.requestCount())
+		}),
+	)
+	return m
+}
+
+func (m *metrics) observeFilter(filter string, start time.Time) {
+	m.filterDuration.WithLabelValues(filter).Observe(time.Since(start).Seconds())
+}
+
+// MetricsHandler serves the metrics of the instance in the Prometheus exposition format
+func (i *Instance) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(i.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// ServeMetrics starts an HTTP listener on addr exposing the metrics on /metrics. It blocks until the listener fails.
+func (i *Instance) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", i.MetricsHandler())
+	i.log.Info("Serving metrics on ", addr)
+	return http.ListenAndServe(addr, mux)
+}
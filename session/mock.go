@@ -42,19 +42,27 @@ func (m *MockResponseWriter) ReadBody() ([]byte, error) {
 type MockRequest struct {
 	readheader mockHeader
 	statuscode int
+	srcip      net.IP
+	method     string
+	vars       map[string][]byte
+	onVar      func() //Called on every Var, which is a round trip to APISIX in the real runner
+	id         uint32 //Random on every call when unset
 }
 
 func (m *MockRequest) ID() uint32 {
+	if m.id != 0 {
+		return m.id
+	}
 	rand.Seed(time.Now().UnixNano())
 	return rand.Uint32()
 }
 
 func (m *MockRequest) SrcIP() net.IP {
-	return nil
+	return m.srcip
 }
 
 func (m *MockRequest) Method() string {
-	return ""
+	return m.method
 }
 
 func (m *MockRequest) Path() []byte {
@@ -69,7 +77,10 @@ func (m *MockRequest) Header() apisixHTTP.Header {
 }
 
 func (m *MockRequest) Var(name string) ([]byte, error) {
-	return nil, nil
+	if m.onVar != nil {
+		m.onVar()
+	}
+	return m.vars[name], nil
 }
 
 func (m *MockRequest) WriteHeader(statusCode int) {
@@ -91,18 +102,24 @@ func (m *MockRequest) RespHeader() http.Header {
 
 // Mock Implementation APISIX HTTP Response for testing
 type MockAPISIXResponseWriter struct {
-	header mockHeader
-	resid  uint32
+	header     mockHeader
+	resid      uint32
+	statuscode int
+	vars       map[string][]byte
+	onVar      func() //See MockRequest.onVar
 }
 
 func (m *MockAPISIXResponseWriter) ID() uint32 {
 	return m.resid
 }
 func (m *MockAPISIXResponseWriter) StatusCode() int {
-	return 0
+	return m.statuscode
 }
 func (m *MockAPISIXResponseWriter) Var(name string) ([]byte, error) {
-	return nil, nil
+	if m.onVar != nil {
+		m.onVar()
+	}
+	return m.vars[name], nil
 }
 func (m *MockAPISIXResponseWriter) Header() apisixHTTP.Header {
 	return &m.header
@@ -115,11 +132,12 @@ func (m *MockAPISIXResponseWriter) Write(b []byte) (int, error) {
 	return 0, nil
 }
 func (m *MockAPISIXResponseWriter) WriteHeader(statusCode int) {
-	return
+	m.statuscode = statusCode
 }
 
 type mockHeader struct {
 	header map[string]string
+	view   http.Header //Built on the first call to View, changes made through it are kept like in the runner
 	mx     sync.RWMutex
 }
 
@@ -130,6 +148,9 @@ func (mh *mockHeader) Set(key, value string) {
 		mh.header = make(map[string]string)
 	}
 	mh.header[key] = value
+	if mh.view != nil {
+		mh.view.Set(key, value)
+	}
 }
 func (mh *mockHeader) Del(key string) {
 	mh.mx.Lock()
@@ -138,6 +159,9 @@ func (mh *mockHeader) Del(key string) {
 		mh.header = make(map[string]string)
 	}
 	delete(mh.header, key)
+	if mh.view != nil {
+		mh.view.Del(key)
+	}
 }
 
 func (mh *mockHeader) Get(key string) string {
@@ -150,5 +174,13 @@ func (mh *mockHeader) Get(key string) string {
 }
 
 func (mh *mockHeader) View() http.Header {
-	return nil
+	mh.mx.Lock()
+	defer mh.mx.Unlock()
+	if mh.view == nil {
+		mh.view = make(http.Header, len(mh.header))
+		for k, v := range mh.header {
+			mh.view.Set(k, v)
+		}
+	}
+	return mh.view
 }
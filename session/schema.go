@@ -0,0 +1,54 @@
+package session
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema is the JSON schema of the route config, as documented in schema.json
+//
+//go:embed schema.json
+var Schema []byte
+
+var compiledSchema = func() *jsonschema.Schema {
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("schema.json", bytes.NewReader(Schema)); err != nil {
+		panic(err)
+	}
+	return c.MustCompile("schema.json")
+}()
+
+// ValidateSchema checks a route config against Schema. Every violation is reported along with the location of the offending field.
+func ValidateSchema(in []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(in, &v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	err := compiledSchema.Validate(v)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	var msgs []string
+	var collect func(ve *jsonschema.ValidationError)
+	collect = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 { //Only the leaves say what is actually wrong
+			location := ve.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			msgs = append(msgs, fmt.Sprintf("%s: %s", location, ve.Message))
+		}
+		for _, cause := range ve.Causes {
+			collect(cause)
+		}
+	}
+	collect(ve)
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -1,17 +1,20 @@
 package session
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
 	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -19,129 +22,271 @@ import (
 const pluginName = "session_manager"
 
 type Instance struct {
-	sessions        map[string]*session //key is a stringified UUID of the session
-	requestSessions map[uint32]*session
-	sessMx          sync.RWMutex
-	reqSessMx       sync.RWMutex
-	log             *zap.SugaredLogger
+	store                      *store
+	storeShards                int
+	maxSessions                int
+	maxUnauthenticatedSessions int
+	pendingRequestTTL          time.Duration
+	log                        *zap.SugaredLogger
+	metrics                    *metrics
+	tracer                     trace.Tracer
+	auditLog                   *zap.Logger
+	logFormat                  string
+	logLevel                   zap.AtomicLevel //Kept to change the level of the running logger, see ApplySettings
+	confMx                     sync.RWMutex
+	routeDefaults              map[string]json.RawMessage //Set by the runner config, see ApplySettings
+	secrets                    map[string]string
+	adminToken                 string
+	fingerprintKey             []byte //See WithFingerprintKey
+	snapshotPath               string //See WithSnapshot
+	snapshotKey                []byte
+	draining                   atomic.Bool //Set by Drain
+	inFlight                   atomic.Int64
 }
 
 type Config struct {
-	SessionTimeoutInSeconds        int    `json:"sessionTimeoutInSeconds"`
-	SessionTimeoutOnFailedRequests int    `json:"failureLimit"` //After this number of failed response, session will be reset to perform a full refresh. Failure is defined as responses with status code>=400
-	CookieName                     string `json:"cookie"`
-	CustomKeyAuth                  string `json:"customKeyAuth"`  //Use custom key auth until the issue described in session struct is fixed. This stores the "password"/"value of custom key "
-	KeyAuthEnabled                 bool   `json:"keyAuthEnabled"` //When using it along with the key-auth plugin, the apiKey is stored in session
+	SessionTimeoutInSeconds        int             `json:"sessionTimeoutInSeconds"`
+	SessionTimeoutOnFailedRequests int             `json:"failureLimit"`        //After this number of failed response, session will be reset to perform a full refresh. Failure is defined as responses with status code>=400
+	CookieName                     string          `json:"cookie"`              //Required unless transport is header
+	Transport                      string          `json:"transport"`           //How the session ID travels between client and runner: cookie (the default) or header
+	TokenHeader                    string          `json:"tokenHeader"`         //Header carrying the session ID when transport is header, defaults to X-Session-Token
+	StripSessionToken              bool            `json:"stripSessionToken"`   //Remove the session cookie, or the token header, from the request passed upstream. Other cookies are kept
+	CustomKeyAuth                  string          `json:"customKeyAuth"`       //Use custom key auth until the issue described in session struct is fixed. This stores the "password"/"value of custom key "
+	CustomKeyAuthSecret            string          `json:"customKeyAuthSecret"` //Name of a runner secret holding the custom key, to keep it out of the route config
+	KeyAuthEnabled                 bool            `json:"keyAuthEnabled"`      //When using it along with the key-auth plugin, the apiKey is stored in session
+	FailurePolicy                  *FailurePolicy  `json:"failurePolicy"`       //Takes precedence over failureLimit when set
+	CircuitBreaker                 *CircuitBreaker `json:"circuitBreaker"`      //When set, a tripped failure policy opens the circuit breaker of the session instead of removing it
+	StickyUpstream                 bool            `json:"stickyUpstream"`      //Pin each session to the upstream node which served it and pass that node to APISIX as a routing hint
+	UpstreamHintHeader             string          `json:"upstreamHintHeader"`  //Request header carrying the routing hint, defaults to X-Session-Upstream
+	StickyFailureLimit             int             `json:"stickyFailureLimit"`  //Number of 5xx responses in a row from the pinned node after which the session is re-pinned, defaults to 1
+	Cohorts                        map[string]int  `json:"cohorts"`             //Weights of the cohorts new sessions are assigned to, e.g. {"stable": 95, "canary": 5}
+	CohortHeader                   string          `json:"cohortHeader"`        //Request header exposing the cohort of the session upstream, defaults to X-Session-Cohort
+	CohortCookie                   string          `json:"cohortCookie"`        //When set, the cohort is also exposed upstream as a cookie of this name
+	StrictConfigMatch              bool            `json:"strictConfigMatch"`   //Fail responses with 500 instead of only logging when ext-plugin-pre-req and ext-plugin-post-resp have different configs
+	CreateOn                       string          `json:"createOn"`            //When a request without a session gets one: always (the default), auth, write or upstream
+	CreateHeader                   string          `json:"createHeader"`        //Response header with which the upstream asks for a session when createOn is upstream, defaults to X-Session-Create
+	CSRF                           bool            `json:"csrf"`                //Require the CSRF token of the session on POST, PUT, PATCH and DELETE requests made with a session
+	CSRFHeader                     string          `json:"csrfHeader"`          //Request header carrying the CSRF token, defaults to X-CSRF-Token. With the header transport, the token is issued in it too
+	CSRFCookie                     string          `json:"csrfCookie"`          //Cookie scripts read the CSRF token from with the cookie transport, defaults to csrf_token
+	CSRFTrustedOrigins             []string        `json:"csrfTrustedOrigins"`  //Origins besides the route's own host unsafe requests may come from, e.g. https://app.example.com
+	fingerprint                    string
 }
 
-// 1-> All status codes bw [100,200)
-// 2 -> All status codes bw [200,300) ...and so on
-func (s *session) addResponseCode(statusCode int) {
-	s.responseCodes[statusCode/100] = append(s.responseCodes[statusCode/100], statusCode)
+// pendingRequest maps a request on its way to the upstream to its session, along with the fingerprint of the config RequestFilter ran with
+type pendingRequest struct {
+	sess              *session
+	configFingerprint string
+	deferred          bool //sess is not stored yet, see Config.CreateOn
+	created           bool //The request created sess, so the client does not know it yet
+	tokenChunks       int  //Number of cookies the session token the client presented was split into, see splitCookie
+	traceParent       trace.SpanContext
+	addedAt           time.Time //See store.addRequest
+	resendCSRF        bool      //The request did not carry the CSRF token of sess, see issueCSRFToken
 }
 
-// Each session represents a client-server sessions and stores information about the client for subsequent requests
+// Each session represents a client-server sessions and stores information about the client for subsequent requests.
+// sessionID, reqID, createdAt and expiresAt are set before the session is stored and never change. The other fields are
+// changed by concurrent requests of the session, and must only be accessed with mx held, except for expiry which is atomic.
 type session struct {
-	reqID         []uint32 //All request IDs associated with this session
-	responseCodes [][]int
-	sessionID     string
+	mx        sync.Mutex
+	reqID     []uint32 //All request IDs associated with this session
+	failures  failureCounter
+	breaker   breakerState
+	sessionID string
 	//Caveat: When using with key-auth plugin, until the first time a valid APIKEY is passed, session wont be created because there is no point in creating a session if the "post-resp" plugin wont be executed which is responsble for writing back sessionID in cookie
 	//TODO,FIXME: Any changes made to header in this plugin are not being respected by subsequent key-auth plugin. For example the apiKey being added in header after extracting from a session is not being respected by key-auth plugin
 	//Use custom key auth until the above is fixed.
-	apiKeyValue    string //When used with key-auth plugin. Make sure to hook session_plugin in pre-req when using alongside key-auth
-	isSticky       bool
-	customKeyValue string
+	apiKeyValue      string //When used with key-auth plugin. Make sure to hook session_plugin in pre-req when using alongside key-auth
+	upstream         string //Address of the upstream node the session is pinned to, when stickyUpstream is enabled
+	upstreamFailures int    //5xx responses in a row from the pinned node
+	customKeyValue   string
+	cohort           string //Canary/A-B cohort the session was assigned to
+	authenticated    bool   //Whether a request of the session passed the auth, see markAuthenticated
+	csrfToken        string //Issued by the first response of the session when csrf is enabled, see issueCSRFToken
+	createdAt        time.Time
+	lastSeen         time.Time                  //Time of the last request made with the session
+	expiresAt        time.Time                  //Zero for sessions without timeout
+	expiry           atomic.Pointer[time.Timer] //Set once the session is stored, see expireAfter
 }
 
-// Reusing apisix's plugin logger function for reusability
-func newLogger(level zapcore.Level, out zapcore.WriteSyncer) *zap.SugaredLogger {
-	var atomicLevel = zap.NewAtomicLevel()
-	atomicLevel.SetLevel(level)
+// Formats of the plugin logs
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
 
+// Reusing apisix's plugin logger function for reusability
+func newLogger(atomicLevel zap.AtomicLevel, out zapcore.WriteSyncer, format string) *zap.SugaredLogger {
+	encoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	if format == LogFormatJSON {
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	}
 	core := zapcore.NewCore(
-		zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
+		encoder,
 		out,
 		atomicLevel)
 	lg := zap.New(core, zap.AddStacktrace(zap.ErrorLevel), zap.AddCaller(), zap.AddCallerSkip(1))
 	return lg.Sugar()
 }
-func New(cfg runner.RunnerConfig) *Instance {
+
+// WithLogFormat selects the format of the plugin logs, LogFormatConsole (the default) or LogFormatJSON
+func WithLogFormat(format string) Option {
+	return func(i *Instance) {
+		i.logFormat = format
+	}
+}
+
+func New(cfg runner.RunnerConfig, opts ...Option) *Instance {
 	if cfg.LogOutput == nil {
 		cfg.LogOutput = os.Stdout
 	}
 	i := &Instance{
-		requestSessions: make(map[uint32]*session),
-		sessions:        make(map[string]*session),
+		storeShards:       defaultStoreShards,
+		pendingRequestTTL: defaultPendingRequestTTL,
+		fingerprintKey:    randomFingerprintKey(),
+	}
+	i.metrics = newMetrics(i)
+	i.tracer = defaultTracer()
+	i.auditLog = zap.NewNop()
+	for _, opt := range opts {
+		opt(i)
+	}
+	i.store = newStore(i.storeShards, i.maxSessions, i.maxUnauthenticatedSessions, i.pendingRequestTTL)
+	i.logLevel = zap.NewAtomicLevelAt(cfg.LogLevel)
+	i.log = newLogger(i.logLevel, cfg.LogOutput, i.logFormat)
+	if i.snapshotPath != "" {
+		i.restoreSnapshot()
 	}
-	i.log = newLogger(cfg.LogLevel, cfg.LogOutput)
 	return i
 }
 
 func (i *Instance) Name() string {
 	return pluginName
 }
-func (i *Instance) removeSession(sid string, reason string) {
-	sess := i.getSession(sid)
-	if sess == nil {
-		return
+
+// Logger is the plugin logger, for the runner to log in the configured format and level
+func (i *Instance) Logger() *zap.SugaredLogger {
+	return i.log
+}
+
+// removeSession reports whether the session was removed by this call
+func (i *Instance) removeSession(sid string, reason string) bool {
+	sess := i.store.removeSession(sid)
+	if sess == nil { //Already removed, e.g. revoked before it timed out
+		return false
+	}
+	i.cleanUpSession(sess, reason)
+	return true
+}
+
+// cleanUpSession forgets the requests of a session which has been taken out of the store and reports the removal
+func (i *Instance) cleanUpSession(sess *session, reason string) {
+	if expiry := sess.expiry.Load(); expiry != nil {
+		expiry.Stop()
+	}
+	i.store.removeRequests(sess.reqID)
+	i.metrics.sessionsRemoved.WithLabelValues(reason).Inc()
+	i.log.Info("Cleaned up session: ", i.fingerprint(sess.sessionID), " due to ", reason)
+	i.audit(auditSessionDestroyed, sess, nil, zap.String("reason", reason))
+}
+
+// addSession stores the session and cleans up the sessions evicted to make room for it
+func (i *Instance) addSession(s *session) {
+	for _, evicted := range i.store.addSession(s, s.authenticated) {
+		i.cleanUpSession(evicted, reasonEvicted)
 	}
-	reqIDs := sess.reqID
-	i.sessMx.Lock()
-	defer i.sessMx.Unlock()
-	delete(i.sessions, sid)
-	i.log.Info("Cleaned up session: ", sid, " due to ", reason)
-	go func(reqIDs []uint32) { // This cleanup can be done lazily
-		for _, reqid := range reqIDs {
-			delete(i.requestSessions, reqid)
-		}
-	}(reqIDs)
 }
+
+// markAuthenticated exempts the session from the limit of unauthenticated sessions. The caller must hold s.mx.
+func (i *Instance) markAuthenticated(s *session) {
+	if !s.authenticated {
+		s.authenticated = true
+		i.store.authenticate(s.sessionID)
+	}
+}
+
+// ParseConf validates a route config against the schema and the constraints across its fields, and fills in its defaults.
+// The returned error is what APISIX reports for the route, so it names the offending fields.
 func (i *Instance) ParseConf(in []byte) (interface{}, error) {
+	in = i.withRouteDefaults(in)
+	if err := ValidateSchema(in); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", pluginName, err)
+	}
 	cfg := Config{}
-	err := json.Unmarshal(in, &cfg)
-	if err != nil {
-		return nil, err
+	dec := json.NewDecoder(bytes.NewReader(in))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", pluginName, err)
 	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", pluginName, err)
+	}
+	if name := cfg.CustomKeyAuthSecret; name != "" {
+		if _, ok := i.secret(name); !ok {
+			return nil, fmt.Errorf("invalid %s config: customKeyAuthSecret: no secret named %q", pluginName, name)
+		}
+	}
+	cfg.setDefaults()
+	cfg.fingerprint = cfg.Fingerprint()
 	return cfg, nil
 }
 
-func getKeyFromCookies(key string, cookies string) (string, bool) {
-	if cookies != "" {
-		cookieStrings := strings.Split(cookies, "; ")
-		for _, cookieString := range cookieStrings {
-			if strings.HasPrefix(cookieString, fmt.Sprintf("%s=", key)) {
-				return strings.TrimPrefix(cookieString, fmt.Sprintf("%s=", key)), true
-			}
+func (i *Instance) getSession(id string) *session {
+	return i.store.session(id)
+}
+
+// findSession returns the first of the presented session IDs which names a stored session, so that a stale duplicate cookie cannot hide
+// the live one. Browsers send the cookie of the most specific path first (RFC 6265 5.4). Without a stored session, the first ID is returned.
+func (i *Instance) findSession(sids []string) (string, *session) {
+	for _, sid := range sids {
+		if sess := i.getSession(sid); sess != nil {
+			return sid, sess
 		}
 	}
-	return "", false
+	if len(sids) == 0 {
+		return "", nil
+	}
+	return sids[0], nil
 }
 
-func (i *Instance) getSession(id string) *session {
-	i.sessMx.RLock()
-	defer i.sessMx.RUnlock()
-	return i.sessions[id]
+// takePendingRequest returns the session a request was made with, once, as the response ends the request
+func (i *Instance) takePendingRequest(id uint32) *pendingRequest {
+	return i.store.takeRequest(id)
+}
+
+// createSession stores the new session p.sess along with the request p which created it
+func (i *Instance) createSession(reqID uint32, p *pendingRequest) {
+	p.created = true
+	i.store.addRequest(reqID, p)
+	i.startSession(p.sess)
 }
-func (i *Instance) getSessionFromRequestID(id uint32) *session {
-	i.reqSessMx.RLock()
-	defer i.reqSessMx.RUnlock()
-	return i.requestSessions[id]
+
+// startSession stores a new session and has it removed once its lifetime is over
+func (i *Instance) startSession(s *session) {
+	i.addSession(s)
+	i.metrics.sessionsCreated.Inc()
+	//It may be the case that the session was created here but before the response could come back, the session was deleted. It will look like a session was never created, since the ResponseFilter wont find any session.
+	//Usually it is assumed that the Latency<SessionTimeout value
+	if !s.expiresAt.IsZero() {
+		i.expireAfter(s)
+	}
 }
-func (i *Instance) createSession(reqID uint32, id string, s *session) {
-	i.reqSessMx.Lock()
-	i.requestSessions[reqID] = s
-	i.reqSessMx.Unlock()
 
-	i.sessMx.Lock()
-	i.sessions[id] = s
-	i.sessMx.Unlock()
+func (i *Instance) addSessionOnRequest(reqID uint32, p *pendingRequest) {
+	i.store.addRequest(reqID, p)
 }
 
-func (i *Instance) addSessionOnRequest(reqID uint32, s *session) {
-	i.reqSessMx.Lock()
-	i.requestSessions[reqID] = s
-	i.reqSessMx.Unlock()
+// dropRequest forgets a request answered by RequestFilter itself, for which ResponseFilter will not be called
+func (i *Instance) dropRequest(reqID uint32) {
+	i.store.removeRequests([]uint32{reqID})
+}
 
+// expireAfter removes the stored session once expiresAt is reached. The timer is stopped when the session is removed before, so that
+// evicted and revoked sessions hold no timer until their lifetime would have been over.
+func (i *Instance) expireAfter(s *session) {
+	s.expiry.Store(time.AfterFunc(time.Until(s.expiresAt), func() {
+		i.removeSession(s.sessionID, reasonTimeout)
+	}))
 }
 
 const APIKEY = "apiKey"
@@ -149,55 +294,150 @@ const CUSTOMAPIKEY = "apiKey"
 
 // RequestFilter is responsible for creating sessions if it doesn't already exist
 func (i *Instance) RequestFilter(cfg interface{}, w http.ResponseWriter, r apisixHTTP.Request) {
-	i.log.Info("Executing Request filter for req: ", r.ID())
+	i.inFlight.Add(1)
+	defer i.inFlight.Add(-1)
+	defer i.metrics.observeFilter("request", time.Now())
+	ft := &filterTrace{auth: authNone}
+	parent := traceParent(r.Header())
+	defer i.endSpan(ft, i.startSpan("session_manager.RequestFilter", parent, time.Now()))
+	reqID := r.ID()
+	i.log.Info("Executing Request filter for req: ", reqID)
 	config := cfg.(Config)
-	cookies := r.Header().Get("Cookie")
-	sid, ok := getKeyFromCookies(config.CookieName, cookies)
-	sess := i.getSession(sid)
+	sids, tokenChunks := config.sessionTokens(r)
+	ok := len(sids) > 0
+	start := time.Now()
+	sid, sess := i.findSession(sids)
+	ft.timeStore(start)
+	if config.StripSessionToken && ok {
+		config.stripSessionToken(r)
+	}
+	stored := true          //False for requests which go on without a session, see Config.CreateOn
 	if !ok || sess == nil { //If no session is found or there exists an expired session then create a new Session
+		previousSID := sid
 		sid := uuid.New().String()
+		now := time.Now()
 		sess = &session{
-			reqID:         []uint32{r.ID()},
-			sessionID:     sid,
-			responseCodes: make([][]int, 6), //To fascillitate status codes upto 500
+			reqID:     []uint32{reqID},
+			sessionID: sid,
+			createdAt: now,
+			lastSeen:  now,
+		}
+		if config.SessionTimeoutInSeconds > 0 {
+			sess.expiresAt = now.Add(time.Second * time.Duration(config.SessionTimeoutInSeconds))
 		}
 		if config.KeyAuthEnabled {
 			sess.apiKeyValue = r.Header().Get(APIKEY)
-			i.log.Info("SET APIKEY IN SESSION AS: ", sess.apiKeyValue, " for session", sess.sessionID)
 		}
-		if config.CustomKeyAuth != "" {
+		if config.customKeyAuthEnabled() {
 			sess.customKeyValue = r.Header().Get(CUSTOMAPIKEY)
-			i.log.Info("SET APIKEY IN SESSION AS: ", sess.customKeyValue, " for session", sess.sessionID)
 		}
-		i.createSession(r.ID(), sid, sess)
-		r.Header().Set("Cookie", fmt.Sprintf("%s=%s", config.CookieName, sid)) //This is useful for sticky sessions. When the sid key that is passed to this plugin is used for chash loadbalancing in upstream
-
-		//It may be the case that the session was created here but before the response could come back, the session was deleted. It will look like a session was never created, since the ResponseFilter wont find any session.
-		//Usually it is assumed that the Latency<SessionTimeout value
-		go func(sid string, timeout int) {
-			if timeout <= 0 { //Timeout less than equal to 0 is considered an infinite session
-				return
+		stored = i.createOnRequest(config, sess, r)
+		if stored && i.draining.Load() { //A session created now would be lost with the runner, the client retries with the next one
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		sess.mx.Lock() //Held until the request is done with the session, as other requests can find it once stored
+		defer sess.mx.Unlock()
+		if !stored { //The request goes on without a session, its response may still create one
+			if config.deferCreation() {
+				i.store.addRequest(reqID, &pendingRequest{sess: sess, configFingerprint: config.Fingerprint(), deferred: true, tokenChunks: tokenChunks, traceParent: parent})
+			}
+		} else {
+			start = time.Now()
+			i.createSession(reqID, &pendingRequest{sess: sess, configFingerprint: config.Fingerprint(), tokenChunks: tokenChunks, traceParent: parent})
+			ft.timeStore(start)
+			ft.isNew = true
+			ft.sess = sess
+			for _, key := range []string{sess.apiKeyValue, sess.customKeyValue} {
+				if key != "" {
+					i.log.Info("Stored api key ", i.fingerprint(key), " in session ", i.fingerprint(sess.sessionID))
+				}
 			}
-			<-time.After(time.Second * time.Duration(timeout))
-			i.removeSession(sid, "timeout")
-		}(sid, config.SessionTimeoutInSeconds)
+			i.audit(auditSessionCreated, sess, r.SrcIP())
+			if ok { //The client presented a session which has expired or has been removed
+				i.audit(auditSessionRotated, sess, r.SrcIP(), zap.String("previous_session", i.fingerprint(previousSID)))
+			}
+			if !config.StripSessionToken {
+				config.passSessionToken(r, sid)
+			}
+		}
 	} else if sess != nil { //Even for existing sessions, the new requestIDs should be associated with them
-		i.addSessionOnRequest(r.ID(), sess)
+		ft.sess = sess
+		var csrfReason string
+		if config.CSRF {
+			csrfReason = config.checkOrigin(r) //Before taking the lock, as it may take a round trip to APISIX
+		}
+		sess.mx.Lock()
+		defer sess.mx.Unlock()
+		pending := &pendingRequest{sess: sess, configFingerprint: config.Fingerprint(), traceParent: parent}
+		if config.CSRF {
+			if csrfReason == "" {
+				csrfReason = config.checkCSRF(sess, r)
+			}
+			if csrfReason != "" { //Forged requests neither refresh the session nor reach the upstream
+				w.WriteHeader(http.StatusForbidden)
+				i.metrics.csrfRejections.Inc()
+				i.log.Info("Rejected cross-site request (", csrfReason, ") for session: ", i.fingerprint(sess.sessionID))
+				i.audit(auditSessionCSRFRejected, sess, r.SrcIP(), zap.String("reason", csrfReason))
+				return
+			}
+			pending.resendCSRF = !config.presentsCSRFToken(sess, r) //E.g. the client lost the cookie, it gets the token again before its next unsafe request
+		}
+		start = time.Now()
+		i.addSessionOnRequest(reqID, pending)
+		ft.timeStore(start)
+		sess.lastSeen = time.Now()
+		if config.CircuitBreaker != nil && !sess.breaker.allow(*config.CircuitBreaker, time.Now(), reqID) {
+			w.Header().Set("Retry-After", strconv.Itoa(sess.breaker.retryAfter(*config.CircuitBreaker, time.Now())))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			i.dropRequest(reqID)
+			return
+		}
+	}
+	if config.StickyUpstream && sess != nil {
+		setUpstreamHint(config, sess, r)
+	}
+	if len(config.Cohorts) > 0 && sess != nil {
+		assignCohort(config, sess)
+		setCohort(config, sess, r)
 	}
 	if config.KeyAuthEnabled && sess != nil { //When used with key-auth plugin, re-add the apiKey in header
-		if r.Header().Get(APIKEY) != "" { //If another API key is sent for subsequent request then respect the new APIKEY to refresh the store
-			sess.apiKeyValue = r.Header().Get(APIKEY)
+		if key := r.Header().Get(APIKEY); key != "" { //If another API key is sent for subsequent request then respect the new APIKEY to refresh the store
+			if sess.apiKeyValue != "" && sess.apiKeyValue != key {
+				i.audit(auditSessionKeyChanged, sess, r.SrcIP(), zap.String("identity", i.fingerprint(key)))
+			}
+			sess.apiKeyValue = key
 		}
 		r.Header().Set(APIKEY, sess.apiKeyValue)
+		if sess.apiKeyValue != "" { //The key itself is checked by key-auth after this plugin
+			i.markAuthenticated(sess)
+		}
 	}
-	if config.CustomKeyAuth != "" && sess != nil {
+	if config.customKeyAuthEnabled() && sess != nil {
+		customKey := i.customKey(config)
 		detectedKey := r.Header().Get(CUSTOMAPIKEY)
 		if detectedKey != "" { //If another API key is sent for subsequent request then respect the new APIKEY to refresh the store
+			if sess.customKeyValue != "" && sess.customKeyValue != detectedKey {
+				i.audit(auditSessionKeyChanged, sess, r.SrcIP(), zap.String("identity", i.fingerprint(detectedKey)))
+			}
 			sess.customKeyValue = detectedKey
 		}
-		if detectedKey != config.CustomKeyAuth && sess.customKeyValue != config.CustomKeyAuth {
-			w.Header().Set("Set-Cookie", fmt.Sprintf("%s=%s", config.CookieName, sess.sessionID)) //ResponseFilter will never be executed as the request will be returned back from here so we need to set the cookie here.
+		if customKey == "" || (detectedKey != customKey && sess.customKeyValue != customKey) { //A secret which went missing rejects everyone rather than no one
+			if ft.isNew {
+				config.returnSessionToken(w.Header(), sess.sessionID, tokenChunks) //ResponseFilter will never be executed as the request will be returned back from here so we need to set the cookie here.
+			}
 			w.WriteHeader(http.StatusUnauthorized)
+			i.dropRequest(reqID)
+			i.metrics.authRejections.Inc()
+			ft.auth = authRejected
+			i.audit(auditSessionRejected, sess, r.SrcIP(), zap.Bool("key_presented", detectedKey != ""))
+		} else {
+			ft.auth = authAccepted
+			i.markAuthenticated(sess)
+			if detectedKey == customKey { //The key was presented in this request rather than taken from the session
+				i.audit(auditSessionAuthenticated, sess, r.SrcIP(), zap.String("identity", i.fingerprint(detectedKey)))
+			}
 		}
 	}
 }
@@ -205,19 +445,83 @@ func (i *Instance) RequestFilter(cfg interface{}, w http.ResponseWriter, r apisi
 // ResponseFilter handles things like:
 // 1. Sticky sessions with cookies (Requires chash type loadbalancing on upstreams)
 func (i *Instance) ResponseFilter(cfg interface{}, w apisixHTTP.Response) {
+	i.inFlight.Add(1)
+	defer i.inFlight.Add(-1)
+	defer i.metrics.observeFilter("response", time.Now())
+	ft := &filterTrace{auth: authNone}
 	config := cfg.(Config)
 	//For some reason the requestID detected in RequestFilter is autoincremented by 1 when detected on response within the lifecycle of same request.
 	//IMPORTANT: It is assumed that this request ID is unique for across requests
 	reqID := w.ID() - 1
 	i.log.Info("Executing Response filter for resp: ", reqID)
-	sess := i.getSessionFromRequestID(reqID)
-	if sess != nil { //Attach the proper cookies on response for existing session
-		sess.addResponseCode(w.StatusCode()) //Store status code
-		fmt.Println(sess.responseCodes)
-		if config.SessionTimeoutOnFailedRequests > 0 && len(sess.responseCodes) > 4 && config.SessionTimeoutOnFailedRequests <= len(sess.responseCodes[4])+len(sess.responseCodes[5]) {
-			i.removeSession(sess.sessionID, "overflown the number of allowed failed requests")
+	start := time.Now()
+	pending := i.takePendingRequest(reqID)
+	ft.timeStore(start)
+	var parent trace.SpanContext
+	if pending != nil {
+		parent = pending.traceParent //Kept by RequestFilter, so that no round trip to APISIX is needed for the request headers
+	}
+	defer i.endSpan(ft, i.startSpan("session_manager.ResponseFilter", parent, start))
+	if pending == nil {
+		return
+	}
+	if fp := config.Fingerprint(); pending.configFingerprint != "" && pending.configFingerprint != fp {
+		i.metrics.configMismatches.Inc()
+		i.log.Error("Config of ext-plugin-post-resp (", fp, ") differs from ext-plugin-pre-req (", pending.configFingerprint, ") for resp: ", reqID, ", pass the same config to both")
+		if config.StrictConfigMatch {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Set-Cookie", fmt.Sprintf("%s=%s", config.CookieName, sess.sessionID))
+	}
+	sess := pending.sess
+	if sess != nil { //Attach the proper cookies on response for existing session
+		var served string
+		if config.StickyUpstream {
+			served = servedBy(w) //Asked before taking the lock, as it takes a round trip to APISIX
+		}
+		sess.mx.Lock()
+		defer sess.mx.Unlock()
+		if pending.deferred {
+			if !i.createOnResponse(config, w, served) {
+				return
+			}
+			start = time.Now()
+			i.startSession(sess)
+			ft.timeStore(start)
+			ft.isNew = true
+			i.audit(auditSessionCreated, sess, nil)
+		}
+		ft.sess = sess
+		policy := config.failurePolicy()
+		if config.CircuitBreaker != nil && sess.breaker.state != breakerClosed {
+			//Responses to requests let through before the breaker opened, or to an earlier probe, tell nothing about the upstream since the cool-down
+			if sess.breaker.isProbe(reqID) {
+				if policy.isFailure(w.StatusCode()) {
+					sess.breaker.open(time.Now())
+				} else {
+					sess.breaker.close()
+					sess.failures.reset()
+				}
+			}
+		} else if sess.failures.record(w.StatusCode(), policy, time.Now()) {
+			if config.CircuitBreaker == nil {
+				start = time.Now()
+				i.removeSession(sess.sessionID, reasonFailureLimit)
+				ft.timeStore(start)
+				return
+			}
+			i.log.Info("Opened circuit breaker for session: ", i.fingerprint(sess.sessionID))
+			sess.breaker.open(time.Now())
+			sess.failures.reset()
+		}
+		if config.StickyUpstream {
+			i.pinUpstream(config, sess, served, w.StatusCode())
+		}
+		if pending.created || pending.deferred { //The client already has the token of older sessions
+			config.addSessionToken(w.Header(), sess.sessionID, pending.tokenChunks)
+		}
+		if config.CSRF {
+			config.issueCSRFToken(sess, w.Header(), pending.resendCSRF)
+		}
 	}
 }
@@ -1,15 +1,288 @@
 package session
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/zap/zapcore"
 )
 
+func TestParseConf(t *testing.T) {
+	type testCase struct {
+		name        string
+		description string
+		conf        string
+		err         string //Expected substring of the error, empty when the config is valid
+		check       func(cfg Config) error
+	}
+	testCases := []testCase{
+		{
+			name:        "TestDefaults",
+			description: "Defaults should be filled in so that the parsed config spells out the effective behaviour",
+			conf:        `{"cookie":"sid","failureLimit":3,"stickyUpstream":true,"cohorts":{"stable":1}}`,
+			check: func(cfg Config) error {
+				if cfg.FailurePolicy == nil || cfg.FailurePolicy.Limit != 3 || cfg.FailurePolicy.Mode != failureModeTotal || len(cfg.FailurePolicy.StatusClasses) != 2 {
+					return fmt.Errorf("failureLimit should be turned into a failure policy, found %+v", cfg.FailurePolicy)
+				}
+				if cfg.UpstreamHintHeader != defaultUpstreamHintHeader || cfg.StickyFailureLimit != 1 || cfg.CohortHeader != defaultCohortHeader {
+					return fmt.Errorf("missing defaults: %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestMissingCookie",
+			description: "cookie is required by the schema",
+			conf:        `{"sessionTimeoutInSeconds":10}`,
+			err:         "missing properties: 'cookie'",
+		},
+		{
+			name:        "TestEmptyCookie",
+			description: "An empty cookie name should be rejected",
+			conf:        `{"cookie":""}`,
+			err:         "/cookie: length must be >= 1",
+		},
+		{
+			name:        "TestNegativeFailureLimit",
+			description: "A negative failureLimit should be rejected",
+			conf:        `{"cookie":"sid","failureLimit":-1}`,
+			err:         "/failureLimit: must be >= 0",
+		},
+		{
+			name:        "TestUnknownField",
+			description: "A typo in a field name should be rejected instead of being silently ignored",
+			conf:        `{"cookie":"sid","failureLimt":3}`,
+			err:         "'failureLimt' not allowed",
+		},
+		{
+			name:        "TestBothKeyAuths",
+			description: "keyAuthEnabled and customKeyAuth should not be used together",
+			conf:        `{"cookie":"sid","keyAuthEnabled":true,"customKeyAuth":"auth-one"}`,
+			err:         "keyAuthEnabled and customKeyAuth cannot be used together",
+		},
+		{
+			name:        "TestCircuitBreakerWithoutPolicy",
+			description: "A circuit breaker can never open without a failure policy",
+			conf:        `{"cookie":"sid","circuitBreaker":{"coolDownInSeconds":10}}`,
+			err:         "circuitBreaker requires",
+		},
+		{
+			name:        "TestHeaderTransport",
+			description: "The cookie is not needed when the session travels in a header",
+			conf:        `{"transport":"header"}`,
+			check: func(cfg Config) error {
+				if cfg.Transport != transportHeader || cfg.TokenHeader != defaultTokenHeader {
+					return fmt.Errorf("expected the token header to be filled in, found %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestCookieTransportWithoutCookie",
+			description: "The cookie transport needs the cookie name",
+			conf:        `{"transport":"cookie"}`,
+			err:         "missing properties: 'cookie'",
+		},
+		{
+			name:        "TestCreateOnAuthWithoutAuth",
+			description: "Sessions created on auth need a route with auth",
+			conf:        `{"cookie":"sid","createOn":"auth"}`,
+			err:         "createOn auth requires",
+		},
+		{
+			name:        "TestCreateOnWriteWithoutWrites",
+			description: "Sessions created on write need something to be written",
+			conf:        `{"cookie":"sid","createOn":"write"}`,
+			err:         "createOn write requires",
+		},
+		{
+			name:        "TestFailureLimitTooLarge",
+			description: "A failure limit beyond the maximum would let one route config pin down large buffers per session",
+			conf:        `{"cookie":"sid","failurePolicy":{"limit":1000000,"windowInSeconds":60}}`,
+			err:         "limit",
+		},
+		{
+			name:        "TestCreateOnUnknown",
+			description: "createOn should be one of the policies",
+			conf:        `{"cookie":"sid","createOn":"never"}`,
+			err:         "createOn",
+		},
+		{
+			name:        "TestCSRFCookieIsSessionCookie",
+			description: "The CSRF cookie cannot be the session cookie or one of its chunks",
+			conf:        `{"cookie":"sid","csrf":true,"csrfCookie":"sid_1"}`,
+			err:         "csrfCookie",
+		},
+		{
+			name:        "TestCSRFTrustedOriginWithPath",
+			description: "Trusted origins should be bare origins",
+			conf:        `{"cookie":"sid","csrf":true,"csrfTrustedOrigins":["https://app.example.com/login"]}`,
+			err:         "csrfTrustedOrigins",
+		},
+	}
+
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	for _, tt := range testCases {
+		cfg, err := i.ParseConf([]byte(tt.conf))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:expected error containing %q, found %v\n", tt.name, tt.description, tt.err, err))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+		if err := tt.check(cfg.(Config)); err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+	}
+}
+
+func TestRouteDefaults(t *testing.T) {
+	type testCase struct {
+		name        string
+		description string
+		conf        string
+		err         string //Expected substring of the error, empty when the config is valid
+		check       func(cfg Config) error
+	}
+	testCases := []testCase{
+		{
+			name:        "TestInherited",
+			description: "A route leaving out fields should get them from the defaults, including the required cookie",
+			conf:        `{"failureLimit":2}`,
+			check: func(cfg Config) error {
+				if cfg.CookieName != "sid" || cfg.SessionTimeoutInSeconds != 60 || cfg.failurePolicy().Limit != 2 {
+					return fmt.Errorf("defaults not merged: %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestOverridden",
+			description: "Fields set by the route should win over the defaults",
+			conf:        `{"cookie":"route-id","sessionTimeoutInSeconds":0}`,
+			check: func(cfg Config) error {
+				if cfg.CookieName != "route-id" || cfg.SessionTimeoutInSeconds != 0 {
+					return fmt.Errorf("route fields overridden by defaults: %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestKnownSecret",
+			description: "customKeyAuthSecret should refer to a secret of the runner",
+			conf:        `{"customKeyAuthSecret":"api"}`,
+		},
+		{
+			name:        "TestUnknownSecret",
+			description: "A route referring to a secret the runner does not have should be rejected",
+			conf:        `{"customKeyAuthSecret":"missing"}`,
+			err:         `no secret named "missing"`,
+		},
+		{
+			name:        "TestSecretAndKey",
+			description: "The key cannot be given both inline and as a secret",
+			conf:        `{"customKeyAuth":"key","customKeyAuthSecret":"api"}`,
+			err:         "cannot be used together",
+		},
+	}
+
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	if err := i.ApplySettings(Settings{RouteDefaults: []byte(`{"cookie":"sid","sessionTimeoutInSeconds":60}`), Secrets: map[string]string{"api": "auth-one"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range testCases {
+		cfg, err := i.ParseConf([]byte(tt.conf))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:expected error containing %q, found %v\n", tt.name, tt.description, tt.err, err))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+		if tt.check != nil {
+			if err := tt.check(cfg.(Config)); err != nil {
+				t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+			}
+		}
+	}
+	if err := i.ApplySettings(Settings{RouteDefaults: []byte(`{"cookies":"sid"}`)}); err == nil {
+		t.Fatal("expected unknown fields in the defaults to be rejected")
+	}
+}
+
+func TestCustomKeyAuthSecret(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	i.ApplySettings(Settings{Secrets: map[string]string{"api": "auth-one"}})
+	cfg := Config{CookieName: "test-id", CustomKeyAuthSecret: "api"}
+	filter := func(key string) int {
+		res := &MockResponseWriter{responseHeader: make(http.Header)}
+		i.RequestFilter(cfg, res, &MockRequest{readheader: mockHeader{header: map[string]string{"apiKey": key}}})
+		return res.statuscode
+	}
+	if status := filter("auth-one"); status != 0 {
+		t.Fatalf("expected the key of the secret to be accepted, found status %d", status)
+	}
+	if status := filter("wrong-key"); status != http.StatusUnauthorized {
+		t.Fatalf("expected another key to be rejected, found status %d", status)
+	}
+	i.ApplySettings(Settings{Secrets: map[string]string{"api": "auth-two"}})
+	if status := filter("auth-two"); status != 0 {
+		t.Fatalf("expected the rotated key to be accepted, found status %d", status)
+	}
+	i.ApplySettings(Settings{Secrets: nil})
+	if status := filter(""); status != http.StatusUnauthorized {
+		t.Fatalf("expected a missing secret to reject requests, found status %d", status)
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard), LogLevel: zapcore.InfoLevel})
+	if err := i.ApplySettings(Settings{LogLevel: zapcore.InfoLevel, Secrets: map[string]string{"api": "auth-one"}, AdminToken: "admin-one"}); err != nil {
+		t.Fatal(err)
+	}
+	i.RequestFilter(Config{CookieName: "test-id"}, &MockResponseWriter{responseHeader: make(http.Header)}, &MockRequest{readheader: mockHeader{header: map[string]string{}}})
+
+	if err := i.ApplySettings(Settings{LogLevel: zapcore.DebugLevel, RouteDefaults: []byte(`{"cookies":"sid"}`), Secrets: map[string]string{"api": "auth-two"}}); err == nil {
+		t.Fatal("expected invalid route defaults to be rejected")
+	}
+	if s, _ := i.secret("api"); s != "auth-one" || i.logLevel.Level() != zapcore.InfoLevel || i.currentAdminToken() != "admin-one" {
+		t.Fatal("rejected settings should leave the current ones in place")
+	}
+
+	if err := i.ApplySettings(Settings{LogLevel: zapcore.DebugLevel, RouteDefaults: []byte(`{"cookie":"sid"}`), Secrets: map[string]string{"api": "auth-two"}, AdminToken: "admin-two"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := i.secret("api"); s != "auth-two" || i.logLevel.Level() != zapcore.DebugLevel || i.currentAdminToken() != "admin-two" {
+		t.Fatal("settings not applied")
+	}
+	if _, err := i.ParseConf([]byte(`{}`)); err != nil {
+		t.Fatalf("expected the new route defaults to apply: %s", err.Error())
+	}
+	if n := i.store.sessionCount(); n != 1 {
+		t.Fatalf("expected sessions to survive the new settings, found %d", n)
+	}
+}
+
 func TestRequestFilter(t *testing.T) {
 	type testCase struct {
 		name            string
@@ -37,7 +310,7 @@ func TestRequestFilter(t *testing.T) {
 			reqSessionState: make(map[uint32]*session),
 			sessionState:    make(map[string]*session),
 			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
-				key, ok := getKeyFromCookies("test-id", req.Header().Get("Cookie"))
+				key, ok := cookieValue("test-id", req.Header().Get("Cookie"))
 				if ok && key == "" {
 					return fmt.Errorf("empty key set")
 				}
@@ -47,6 +320,75 @@ func TestRequestFilter(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name:        "TestOtherCookiesKept",
+			description: "A new session should replace only the session cookie the client sent, the other cookies should reach the upstream",
+			cfg: Config{
+				CookieName: "test-id",
+			},
+			req: &MockRequest{
+				readheader: mockHeader{header: map[string]string{"Cookie": "theme=dark;test-id=expired; lang=en"}},
+			},
+			res:             &MockResponseWriter{responseHeader: make(http.Header)},
+			reqSessionState: make(map[uint32]*session),
+			sessionState:    make(map[string]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				cookies := req.Header().Get("Cookie")
+				key, _ := cookieValue("test-id", cookies)
+				if sess[key] == nil || !strings.HasPrefix(cookies, "theme=dark; lang=en; ") {
+					return fmt.Errorf("expected the other cookies and the new session cookie, found %q", cookies)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestStripSessionCookie",
+			description: "With stripSessionToken the upstream should not see the session cookie of an existing session",
+			cfg: Config{
+				CookieName:        "test-id",
+				StripSessionToken: true,
+			},
+			req: &MockRequest{
+				readheader: mockHeader{header: map[string]string{"Cookie": "theme=dark; test-id=abc"}},
+			},
+			res: &MockResponseWriter{responseHeader: make(http.Header)},
+			sessionState: map[string]*session{
+				"abc": {sessionID: "abc"},
+			},
+			reqSessionState: make(map[uint32]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if cookies := req.Header().Get("Cookie"); cookies != "theme=dark" {
+					return fmt.Errorf("expected only the other cookies, found %q", cookies)
+				}
+				if len(sess) != 1 {
+					return fmt.Errorf("expected the existing session to be used, found %d sessions", len(sess))
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestStripNewSessionCookie",
+			description: "With stripSessionToken a new session should not be passed upstream, and a Cookie header left empty should be removed",
+			cfg: Config{
+				CookieName:        "test-id",
+				StripSessionToken: true,
+			},
+			req: &MockRequest{
+				readheader: mockHeader{header: map[string]string{"Cookie": "test-id=expired"}},
+			},
+			res:             &MockResponseWriter{responseHeader: make(http.Header)},
+			reqSessionState: make(map[uint32]*session),
+			sessionState:    make(map[string]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if _, ok := req.readheader.header["Cookie"]; ok {
+					return fmt.Errorf("expected no Cookie header, found %q", req.readheader.header["Cookie"])
+				}
+				if len(sess) != 1 {
+					return fmt.Errorf("expected a new session, found %d sessions", len(sess))
+				}
+				return nil
+			},
+		},
 		{
 			name:        "TestCustomKeyAuth",
 			description: "When session is non existent and apiKey is not passed in header then reject the calls with 401 along with a newly created session",
@@ -72,7 +414,7 @@ func TestRequestFilter(t *testing.T) {
 				if cookies == "" {
 					return fmt.Errorf("no instruction to set cookie")
 				}
-				key, ok := getKeyFromCookies("test-id", cookies)
+				key, ok := cookieValue("test-id", cookies)
 				if ok && key == "" {
 					return fmt.Errorf("empty key set")
 				}
@@ -152,123 +494,1278 @@ func TestRequestFilter(t *testing.T) {
 				return nil
 			},
 		},
-	}
-
-	for _, tt := range testCases {
-		i := New(runner.RunnerConfig{}) // A new instance of plugin
-		i.sessions = tt.sessionState
-		i.requestSessions = tt.reqSessionState
-		i.RequestFilter(tt.cfg, tt.res, tt.req)
-		err := tt.check(tt.req, tt.res, tt.sessionState)
-		if err != nil {
-			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
-		}
-	}
-}
-
-// BenchmarkRequestFilter_SessionSetting simulates new user requests triggering session creation.
-// Caveat: The MockRequest generates and returns a random uint32 so the final time will include that.
-func BenchmarkRequestFilter_SessionSetting(b *testing.B) {
-
-	b.ReportAllocs() //Equivalent to setting -benchmem flag
-	type testCase struct {
-		name            string
-		description     string
-		cfg             Config
-		sessionState    map[string]*session //To be used for mocking a session state before Filter handling
-		reqSessionState map[uint32]*session //To be used for mocking a session state before Filter handling
-		req             *MockRequest
-		res             *MockResponseWriter
-	}
-	tt := testCase{
-		name:        "TestSessionSetting",
-		description: "Very basic capability of Filter function to set a new session in cookie for a new request",
-		cfg: Config{
-			CookieName: "test-id",
-		},
-		req: &MockRequest{
-			readheader: mockHeader{header: make(map[string]string)},
-		},
-		res: &MockResponseWriter{
-			writeheader: mockHeader{header: make(map[string]string)},
-		},
-		reqSessionState: make(map[uint32]*session),
-		sessionState:    make(map[string]*session),
-	}
-	i := New(runner.RunnerConfig{
-		LogOutput: zapcore.AddSync(ioutil.Discard),
-	}) // A new instance of plugin
-	i.sessions = tt.sessionState
-	i.requestSessions = tt.reqSessionState
-	b.ResetTimer() //Start the timer after all initializations are done
-	for j := 0; j < b.N; j++ {
-		i.RequestFilter(tt.cfg, tt.res, tt.req)
-	}
-}
-
-func TestResponseFilter(t *testing.T) {
-	type testCase struct {
-		name            string
-		description     string
-		sessionState    map[string]*session //To be used for mocking a session state before Filter handling
-		reqSessionState map[uint32]*session //To be used for mocking a session state before Filter handling
-		cfg             Config
-		res             *MockAPISIXResponseWriter
-		check           func(res *MockAPISIXResponseWriter) error
-	}
-	testCases := []testCase{
 		{
-			name:        "TestSessionSetting",
-			description: "Very basic capability of Filter function to set a new session in cookie for returned responses",
+			name:        "TestCircuitBreakerOpen",
+			description: "Requests of a session with an open circuit breaker should be short-circuited with 503 until the cool-down is over",
 			cfg: Config{
-				CookieName: "test-id",
-			},
-			res: &MockAPISIXResponseWriter{
-				header: mockHeader{header: map[string]string{
-					"Cookie": "test-id=xyz",
-				}},
-				resid: 124, //As you can see the response ID is 1+reqID
+				CookieName:     "test-id",
+				CircuitBreaker: &CircuitBreaker{CoolDownInSeconds: 30},
 			},
-			sessionState: map[string]*session{ //Emulating session creation of Request Filter
-				"xyz": {
-					responseCodes: make([][]int, 6), //To fascillitate status codes upto 500,
+			req: &MockRequest{
+				readheader: mockHeader{
+					header: map[string]string{
+						"Cookie": "test-id=abc",
+					},
 				},
 			},
-			reqSessionState: map[uint32]*session{
-				123: {
-					sessionID:     "xyz",
-					responseCodes: make([][]int, 6), //To fascillitate status codes upto 500,
+			res: &MockResponseWriter{
+				writeheader:    mockHeader{header: make(map[string]string)},
+				responseHeader: make(http.Header),
+			},
+			sessionState: map[string]*session{
+				"abc": {
+					sessionID: "abc",
+					breaker:   breakerState{state: breakerOpen, openedAt: time.Now()},
 				},
 			},
-			check: func(res *MockAPISIXResponseWriter) error {
-				cookies := res.Header().Get("Set-Cookie")
-				if len(cookies) == 0 {
-					return fmt.Errorf("no instruction to set cookie")
-				}
-				key, ok := getKeyFromCookies("test-id", cookies)
-				if ok && key == "" {
-					return fmt.Errorf("empty key set")
+			reqSessionState: make(map[uint32]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if res.statuscode != http.StatusServiceUnavailable {
+					return fmt.Errorf("expected status code:%d, found %d", http.StatusServiceUnavailable, res.statuscode)
 				}
-				if !ok {
-					return fmt.Errorf("no cookie found for test-id")
+				if res.Header().Get("Retry-After") != "30" {
+					return fmt.Errorf("expected Retry-After: 30, found %s", res.Header().Get("Retry-After"))
 				}
 				return nil
 			},
 		},
-	}
-
-	for _, tt := range testCases {
-		i := New(runner.RunnerConfig{}) // A new instance of plugin
-		i.sessions = tt.sessionState
-		i.requestSessions = tt.reqSessionState
-		i.ResponseFilter(tt.cfg, tt.res)
-		err := tt.check(tt.res)
-		if err != nil {
-			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
-		}
-	}
-}
-
-// func BenchmarkResponseFilter(b *testing.B) {
-
-// }
+		{
+			name:        "TestCircuitBreakerProbe",
+			description: "Once the cool-down is over a probe request should be let through and the breaker should become half-open",
+			cfg: Config{
+				CookieName:     "test-id",
+				CircuitBreaker: &CircuitBreaker{CoolDownInSeconds: 30},
+			},
+			req: &MockRequest{
+				readheader: mockHeader{
+					header: map[string]string{
+						"Cookie": "test-id=abc",
+					},
+				},
+			},
+			res: &MockResponseWriter{
+				writeheader:    mockHeader{header: make(map[string]string)},
+				responseHeader: make(http.Header),
+			},
+			sessionState: map[string]*session{
+				"abc": {
+					sessionID: "abc",
+					breaker:   breakerState{state: breakerOpen, openedAt: time.Now().Add(-time.Minute)},
+				},
+			},
+			reqSessionState: make(map[uint32]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if res.statuscode != 0 {
+					return fmt.Errorf("expected the probe to go through, found status code %d", res.statuscode)
+				}
+				if sess["abc"].breaker.state != breakerHalfOpen {
+					return fmt.Errorf("expected the breaker to be half-open")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestStickyUpstreamHint",
+			description: "The node a session is pinned to should be passed upstream as a routing hint, replacing any hint sent by the client",
+			cfg: Config{
+				CookieName:     "test-id",
+				StickyUpstream: true,
+			},
+			req: &MockRequest{
+				readheader: mockHeader{
+					header: map[string]string{
+						"Cookie":             "test-id=abc",
+						"X-Session-Upstream": "10.0.0.9:80",
+					},
+				},
+			},
+			res: &MockResponseWriter{
+				writeheader:    mockHeader{header: make(map[string]string)},
+				responseHeader: make(http.Header),
+			},
+			sessionState: map[string]*session{
+				"abc": {
+					sessionID: "abc",
+					upstream:  "10.0.0.1:80",
+				},
+			},
+			reqSessionState: make(map[uint32]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if hint := req.Header().Get("X-Session-Upstream"); hint != "10.0.0.1:80" {
+					return fmt.Errorf("expected hint %s, found %s", "10.0.0.1:80", hint)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestCohortAssignment",
+			description: "A new session should be assigned a cohort by weight and the cohort should be exposed upstream as a header and a cookie",
+			cfg: Config{
+				CookieName:   "test-id",
+				Cohorts:      map[string]int{"stable": 0, "canary": 5},
+				CohortCookie: "cohort",
+			},
+			req: &MockRequest{
+				readheader: mockHeader{
+					header: map[string]string{
+						"X-Session-Cohort": "stable", //Clients should not be able to pick their cohort
+					},
+				},
+			},
+			res: &MockResponseWriter{
+				writeheader:    mockHeader{header: make(map[string]string)},
+				responseHeader: make(http.Header),
+			},
+			sessionState:    make(map[string]*session),
+			reqSessionState: make(map[uint32]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if cohort := req.Header().Get("X-Session-Cohort"); cohort != "canary" {
+					return fmt.Errorf("expected cohort canary in header, found %s", cohort)
+				}
+				if cohort, _ := cookieValue("cohort", req.Header().Get("Cookie")); cohort != "canary" {
+					return fmt.Errorf("expected cohort canary in cookie, found %s", cohort)
+				}
+				if _, ok := cookieValue("test-id", req.Header().Get("Cookie")); !ok {
+					return fmt.Errorf("cohort cookie should not replace the session cookie")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestCohortIsStable",
+			description: "An existing session should keep its cohort as long as the cohort is configured",
+			cfg: Config{
+				CookieName: "test-id",
+				Cohorts:    map[string]int{"stable": 0, "canary": 5},
+			},
+			req: &MockRequest{
+				readheader: mockHeader{
+					header: map[string]string{
+						"Cookie": "test-id=abc",
+					},
+				},
+			},
+			res: &MockResponseWriter{
+				writeheader:    mockHeader{header: make(map[string]string)},
+				responseHeader: make(http.Header),
+			},
+			sessionState: map[string]*session{
+				"abc": {
+					sessionID: "abc",
+					cohort:    "stable",
+				},
+			},
+			reqSessionState: make(map[uint32]*session),
+			check: func(req *MockRequest, res *MockResponseWriter, sess map[string]*session) error {
+				if cohort := req.Header().Get("X-Session-Cohort"); cohort != "stable" {
+					return fmt.Errorf("expected cohort stable, found %s", cohort)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		i := New(runner.RunnerConfig{}) // A new instance of plugin
+		seed(i, tt.sessionState, tt.reqSessionState)
+		i.RequestFilter(tt.cfg, tt.res, tt.req)
+		sessions := make(map[string]*session)
+		for _, sess := range i.store.sessions() {
+			sessions[sess.sessionID] = sess
+		}
+		err := tt.check(tt.req, tt.res, sessions)
+		if err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+	}
+}
+
+// BenchmarkRequestFilter_SessionSetting simulates new user requests triggering session creation.
+// Caveat: The MockRequest generates and returns a random uint32 so the final time will include that.
+func BenchmarkRequestFilter_SessionSetting(b *testing.B) {
+
+	b.ReportAllocs() //Equivalent to setting -benchmem flag
+	type testCase struct {
+		name            string
+		description     string
+		cfg             Config
+		sessionState    map[string]*session //To be used for mocking a session state before Filter handling
+		reqSessionState map[uint32]*session //To be used for mocking a session state before Filter handling
+		req             *MockRequest
+		res             *MockResponseWriter
+	}
+	tt := testCase{
+		name:        "TestSessionSetting",
+		description: "Very basic capability of Filter function to set a new session in cookie for a new request",
+		cfg: Config{
+			CookieName: "test-id",
+		},
+		req: &MockRequest{
+			readheader: mockHeader{header: make(map[string]string)},
+		},
+		res: &MockResponseWriter{
+			writeheader: mockHeader{header: make(map[string]string)},
+		},
+		reqSessionState: make(map[uint32]*session),
+		sessionState:    make(map[string]*session),
+	}
+	i := New(runner.RunnerConfig{
+		LogOutput: zapcore.AddSync(ioutil.Discard),
+	}) // A new instance of plugin
+	seed(i, tt.sessionState, tt.reqSessionState)
+	b.ResetTimer() //Start the timer after all initializations are done
+	for j := 0; j < b.N; j++ {
+		i.RequestFilter(tt.cfg, tt.res, tt.req)
+	}
+}
+
+func TestResponseFilter(t *testing.T) {
+	type testCase struct {
+		name            string
+		description     string
+		sessionState    map[string]*session //To be used for mocking a session state before Filter handling
+		reqSessionState map[uint32]*session //To be used for mocking a session state before Filter handling
+		created         bool                //Whether RequestFilter created the sessions of reqSessionState
+		cfg             Config
+		res             *MockAPISIXResponseWriter
+		check           func(res *MockAPISIXResponseWriter) error
+	}
+	testCases := []testCase{
+		{
+			name:        "TestSessionSetting",
+			description: "Very basic capability of Filter function to set a new session in cookie for returned responses",
+			cfg: Config{
+				CookieName: "test-id",
+			},
+			res: &MockAPISIXResponseWriter{
+				header: mockHeader{header: map[string]string{
+					"Cookie": "test-id=xyz",
+				}},
+				resid: 124, //As you can see the response ID is 1+reqID
+			},
+			created: true,
+			sessionState: map[string]*session{ //Emulating session creation of Request Filter
+				"xyz": {
+					sessionID: "xyz",
+				},
+			},
+			reqSessionState: map[uint32]*session{
+				123: {
+					sessionID: "xyz",
+				},
+			},
+			check: func(res *MockAPISIXResponseWriter) error {
+				cookies := res.Header().Get("Set-Cookie")
+				if len(cookies) == 0 {
+					return fmt.Errorf("no instruction to set cookie")
+				}
+				key, ok := cookieValue("test-id", cookies)
+				if ok && key == "" {
+					return fmt.Errorf("empty key set")
+				}
+				if !ok {
+					return fmt.Errorf("no cookie found for test-id")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestExistingSession",
+			description: "The client already has the cookie of an existing session, so it should not be set again",
+			cfg: Config{
+				CookieName: "test-id",
+			},
+			res: &MockAPISIXResponseWriter{
+				resid: 124,
+			},
+			sessionState: map[string]*session{
+				"xyz": {
+					sessionID: "xyz",
+				},
+			},
+			reqSessionState: map[uint32]*session{
+				123: {
+					sessionID: "xyz",
+				},
+			},
+			check: func(res *MockAPISIXResponseWriter) error {
+				if cookies := res.Header().View().Values("Set-Cookie"); len(cookies) != 0 {
+					return fmt.Errorf("expected no cookie, found %v", cookies)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestUpstreamCookiesKept",
+			description: "The session cookie should be added to the cookies the upstream set, replacing only a cookie of its own name",
+			cfg: Config{
+				CookieName: "test-id",
+			},
+			res: &MockAPISIXResponseWriter{
+				header: mockHeader{view: http.Header{"Set-Cookie": {"csrf=abc; HttpOnly", "test-id=upstream", "theme=dark"}}},
+				resid:  124,
+			},
+			sessionState: map[string]*session{
+				"xyz": {
+					sessionID: "xyz",
+				},
+			},
+			reqSessionState: map[uint32]*session{
+				123: {
+					sessionID: "xyz",
+				},
+			},
+			created: true,
+			check: func(res *MockAPISIXResponseWriter) error {
+				var cookies []string
+				for name, values := range res.Header().View() {
+					if strings.EqualFold(name, "Set-Cookie") && name != "Set-Cookie" { //What the runner passes back to APISIX
+						cookies = append(cookies, values...)
+					}
+				}
+				sort.Strings(cookies)
+				if fmt.Sprint(cookies) != "[csrf=abc; HttpOnly test-id=xyz theme=dark]" {
+					return fmt.Errorf("expected the upstream cookies along with the session cookie, found %v", cookies)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestFailurePolicyTrips",
+			description: "A response counted as failure by the policy should remove the session once the limit is reached instead of refreshing the cookie",
+			cfg: Config{
+				CookieName: "test-id",
+				FailurePolicy: &FailurePolicy{
+					Limit:         1,
+					StatusClasses: []int{5},
+				},
+			},
+			res: &MockAPISIXResponseWriter{
+				resid:      124,
+				statuscode: 503,
+			},
+			sessionState: map[string]*session{
+				"xyz": {
+					sessionID: "xyz",
+				},
+			},
+			reqSessionState: map[uint32]*session{
+				123: {
+					sessionID: "xyz",
+				},
+			},
+			check: func(res *MockAPISIXResponseWriter) error {
+				if cookies := res.Header().Get("Set-Cookie"); cookies != "" {
+					return fmt.Errorf("expected no cookie for a removed session, found %s", cookies)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestFailurePolicyIgnoresOtherClasses",
+			description: "A 404 should not count as a failure when the policy only counts 5xx responses",
+			cfg: Config{
+				CookieName: "test-id",
+				FailurePolicy: &FailurePolicy{
+					Limit:         1,
+					StatusClasses: []int{5},
+				},
+			},
+			res: &MockAPISIXResponseWriter{
+				resid:      124,
+				statuscode: 404,
+			},
+			sessionState: map[string]*session{
+				"xyz": {
+					sessionID: "xyz",
+				},
+			},
+			reqSessionState: map[uint32]*session{
+				123: {
+					sessionID: "xyz",
+				},
+			},
+			created: true, //The cookie is only set for a session which is kept
+			check: func(res *MockAPISIXResponseWriter) error {
+				if _, ok := cookieValue("test-id", res.Header().Get("Set-Cookie")); !ok {
+					return fmt.Errorf("no cookie found for test-id")
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		i := New(runner.RunnerConfig{}) // A new instance of plugin
+		seed(i, tt.sessionState, tt.reqSessionState)
+		if tt.created {
+			for id, sess := range tt.reqSessionState {
+				i.store.addRequest(id, &pendingRequest{sess: sess, created: true})
+			}
+		}
+		i.ResponseFilter(tt.cfg, tt.res)
+		err := tt.check(tt.res)
+		if err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+	}
+}
+
+// seed stores sessions, and maps request IDs to sessions the way RequestFilter does, without a config fingerprint
+func seed(i *Instance, sessions map[string]*session, reqSessions map[uint32]*session) {
+	for _, sess := range sessions {
+		i.addSession(sess)
+	}
+	for id, sess := range reqSessions {
+		i.store.addRequest(id, &pendingRequest{sess: sess})
+	}
+}
+
+func TestConfigFingerprintSecret(t *testing.T) {
+	a, b := Config{CookieName: "sid", CustomKeyAuth: "auth-one"}, Config{CookieName: "sid", CustomKeyAuth: "auth-two"}
+	if a.Fingerprint() != b.Fingerprint() || a.Fingerprint() == (Config{CookieName: "sid"}).Fingerprint() {
+		t.Fatal("expected the fingerprint to tell whether custom key auth is enabled but not depend on the key")
+	}
+}
+
+func TestConfigMismatch(t *testing.T) {
+	type testCase struct {
+		name        string
+		description string
+		reqConf     string
+		respConf    string
+		check       func(i *Instance, res *MockAPISIXResponseWriter) error
+	}
+	testCases := []testCase{
+		{
+			name:        "TestSameConfig",
+			description: "Configs equal once parsed should match even when written differently",
+			reqConf:     `{"cookie": "test-id", "failureLimit": 2}`,
+			respConf:    `{"failureLimit": 2, "cookie": "test-id", "sessionTimeoutInSeconds": 0}`,
+			check: func(i *Instance, res *MockAPISIXResponseWriter) error {
+				if n := testutil.ToFloat64(i.metrics.configMismatches); n != 0 {
+					return fmt.Errorf("expected no mismatch, found %v", n)
+				}
+				if res.statuscode != 0 {
+					return fmt.Errorf("expected the status to be left alone, found %d", res.statuscode)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestMismatchLogged",
+			description: "A different config in the response phase should be counted but the response left alone",
+			reqConf:     `{"cookie": "test-id"}`,
+			respConf:    `{"cookie": "other-id"}`,
+			check: func(i *Instance, res *MockAPISIXResponseWriter) error {
+				if n := testutil.ToFloat64(i.metrics.configMismatches); n != 1 {
+					return fmt.Errorf("expected 1 mismatch, found %v", n)
+				}
+				if res.statuscode != 0 {
+					return fmt.Errorf("expected the status to be left alone, found %d", res.statuscode)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestMismatchStrict",
+			description: "With strictConfigMatch a different config in the response phase should fail the response",
+			reqConf:     `{"cookie": "test-id", "strictConfigMatch": true}`,
+			respConf:    `{"cookie": "other-id", "strictConfigMatch": true}`,
+			check: func(i *Instance, res *MockAPISIXResponseWriter) error {
+				if res.statuscode != http.StatusInternalServerError {
+					return fmt.Errorf("expected 500, found %d", res.statuscode)
+				}
+				if cookies := res.Header().Get("Set-Cookie"); cookies != "" {
+					return fmt.Errorf("expected no cookie, found %s", cookies)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+		reqConf, err := i.ParseConf([]byte(tt.reqConf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		respConf, err := i.ParseConf([]byte(tt.respConf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess := &session{sessionID: "xyz"}
+		i.addSession(sess)
+		i.store.addRequest(123, &pendingRequest{sess: sess, configFingerprint: reqConf.(Config).Fingerprint()})
+		res := &MockAPISIXResponseWriter{resid: 124}
+		i.ResponseFilter(respConf, res)
+		if err := tt.check(i, res); err != nil {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:%s\n", tt.name, tt.description, err.Error()))
+		}
+	}
+}
+
+func TestCreateOn(t *testing.T) {
+	type testCase struct {
+		name        string
+		description string
+		conf        string
+		reqHeader   map[string]string
+		res         *MockAPISIXResponseWriter
+		sessions    int  //Expected number of stored sessions once the response is done
+		cookie      bool //Whether the client is expected to get a cookie
+		status      int  //Status RequestFilter is expected to answer with, 0 when the request goes upstream
+	}
+	testCases := []testCase{
+		{
+			name:        "TestAlways",
+			description: "By default every request without a cookie should get a session",
+			conf:        `{"cookie":"sid"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 200},
+			sessions:    1,
+			cookie:      true,
+		},
+		{
+			name:        "TestAuthRejected",
+			description: "A request failing the auth should get neither a session nor a cookie",
+			conf:        `{"cookie":"sid","customKeyAuth":"auth-one","createOn":"auth"}`,
+			reqHeader:   map[string]string{CUSTOMAPIKEY: "wrong"},
+			status:      http.StatusUnauthorized,
+		},
+		{
+			name:        "TestAuthAccepted",
+			description: "A request passing the auth should get a session",
+			conf:        `{"cookie":"sid","customKeyAuth":"auth-one","createOn":"auth"}`,
+			reqHeader:   map[string]string{CUSTOMAPIKEY: "auth-one"},
+			res:         &MockAPISIXResponseWriter{statuscode: 200},
+			sessions:    1,
+			cookie:      true,
+		},
+		{
+			name:        "TestAuthWithoutKey",
+			description: "A request without API key should go on to key-auth without a session",
+			conf:        `{"cookie":"sid","keyAuthEnabled":true,"createOn":"auth"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 401},
+		},
+		{
+			name:        "TestWriteKey",
+			description: "An API key which passes the auth is written on the first request",
+			conf:        `{"cookie":"sid","customKeyAuth":"auth-one","createOn":"write"}`,
+			reqHeader:   map[string]string{CUSTOMAPIKEY: "auth-one"},
+			res:         &MockAPISIXResponseWriter{statuscode: 200},
+			sessions:    1,
+			cookie:      true,
+		},
+		{
+			name:        "TestWriteRejectedKey",
+			description: "A rejected API key is nothing to keep, so neither a session nor a cookie should come with the 401",
+			conf:        `{"cookie":"sid","customKeyAuth":"auth-one","createOn":"write"}`,
+			reqHeader:   map[string]string{CUSTOMAPIKEY: "garbage"},
+			status:      http.StatusUnauthorized,
+		},
+		{
+			name:        "TestWriteCohort",
+			description: "A cohort is written on the first request",
+			conf:        `{"cookie":"sid","cohorts":{"stable":1},"createOn":"write"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 200},
+			sessions:    1,
+			cookie:      true,
+		},
+		{
+			name:        "TestWriteUpstream",
+			description: "The node to pin to is written by the response",
+			conf:        `{"cookie":"sid","stickyUpstream":true,"createOn":"write"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 200, vars: map[string][]byte{"upstream_addr": []byte("10.0.0.1:80")}},
+			sessions:    1,
+			cookie:      true,
+		},
+		{
+			name:        "TestWriteUpstreamFailed",
+			description: "A failed response has no node to pin to",
+			conf:        `{"cookie":"sid","stickyUpstream":true,"createOn":"write"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 502, vars: map[string][]byte{"upstream_addr": []byte("10.0.0.1:80")}},
+		},
+		{
+			name:        "TestUpstreamAsks",
+			description: "The upstream should get a session created with the create header",
+			conf:        `{"cookie":"sid","createOn":"upstream"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 200, header: mockHeader{header: map[string]string{defaultCreateHeader: "1"}}},
+			sessions:    1,
+			cookie:      true,
+		},
+		{
+			name:        "TestUpstreamDoesNotAsk",
+			description: "Without the create header the response should go back without a session",
+			conf:        `{"cookie":"sid","createOn":"upstream"}`,
+			res:         &MockAPISIXResponseWriter{statuscode: 200},
+		},
+	}
+
+	for _, tt := range testCases {
+		i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+		cfg, err := i.ParseConf([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := map[string]string{}
+		for k, v := range tt.reqHeader {
+			header[k] = v
+		}
+		w := &MockResponseWriter{responseHeader: make(http.Header)}
+		req := &MockRequest{id: 1, readheader: mockHeader{header: header}}
+		i.RequestFilter(cfg, w, req)
+		if w.statuscode != tt.status {
+			t.Fatalf("%s: %s: expected status %d from RequestFilter, found %d", tt.name, tt.description, tt.status, w.statuscode)
+		}
+		cookie := w.Header().Get("Set-Cookie")
+		if tt.res != nil {
+			tt.res.resid = 2
+			i.ResponseFilter(cfg, tt.res)
+			cookie += tt.res.Header().Get("Set-Cookie")
+			if tt.res.Header().Get(defaultCreateHeader) != "" {
+				t.Fatalf("%s: %s: expected the create header not to reach the client", tt.name, tt.description)
+			}
+		}
+		if n := i.store.sessionCount(); n != tt.sessions {
+			t.Fatalf("%s: %s: expected %d sessions, found %d", tt.name, tt.description, tt.sessions, n)
+		}
+		if (cookie != "") != tt.cookie {
+			t.Fatalf("%s: %s: expected cookie %v, found %q", tt.name, tt.description, tt.cookie, cookie)
+		}
+		if n := i.store.requestCount(); n != 0 {
+			t.Fatalf("%s: %s: expected the request to be forgotten, found %d pending", tt.name, tt.description, n)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"transport":"header","tokenHeader":"X-Session","customKeyAuth":"auth-one"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var next uint32
+	send := func(header map[string]string) (*MockRequest, *MockResponseWriter, *MockAPISIXResponseWriter) {
+		next += 2
+		req := &MockRequest{id: next, readheader: mockHeader{header: header}}
+		w := &MockResponseWriter{responseHeader: make(http.Header)}
+		i.RequestFilter(cfg, w, req)
+		res := &MockAPISIXResponseWriter{resid: next + 1, statuscode: 200}
+		if w.statuscode == 0 {
+			i.ResponseFilter(cfg, res)
+		}
+		return req, w, res
+	}
+
+	type testCase struct {
+		name        string
+		description string
+		check       func() error
+	}
+	var sid string
+	testCases := []testCase{
+		{
+			name:        "TestNewSession",
+			description: "A new session should be passed upstream and returned to the client in the token header, not in a cookie",
+			check: func() error {
+				req, _, res := send(map[string]string{CUSTOMAPIKEY: "auth-one"})
+				sid = res.Header().Get("X-Session")
+				if sid == "" || req.readheader.header["X-Session"] != sid {
+					return fmt.Errorf("expected the session ID in the token header, found %q upstream and %q returned", req.readheader.header["X-Session"], sid)
+				}
+				if cookie := res.Header().Get("Set-Cookie") + req.readheader.header["Cookie"]; cookie != "" {
+					return fmt.Errorf("expected no cookie, found %q", cookie)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestExistingSession",
+			description: "A client presenting the token should be served from its session without sending the key or getting the token again",
+			check: func() error {
+				_, w, res := send(map[string]string{"X-Session": sid})
+				if w.statuscode != 0 || i.store.sessionCount() != 1 {
+					return fmt.Errorf("expected the session to be reused, found status %d and %d sessions", w.statuscode, i.store.sessionCount())
+				}
+				if token := res.Header().Get("X-Session"); token != "" {
+					return fmt.Errorf("expected the token not to be sent again, found %q", token)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "TestCookieIgnored",
+			description: "A cookie should not be taken for the token",
+			check: func() error {
+				_, w, _ := send(map[string]string{"Cookie": "X-Session=" + sid})
+				if w.statuscode != http.StatusUnauthorized || w.Header().Get("X-Session") == sid || w.Header().Get("X-Session") == "" {
+					return fmt.Errorf("expected a new session to be rejected, found status %d and token %q", w.statuscode, w.Header().Get("X-Session"))
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range testCases {
+		if err := tt.check(); err != nil {
+			t.Fatalf("%s: %s: %s", tt.name, tt.description, err.Error())
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid","csrf":true,"csrfTrustedOrigins":["https://app.example.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The first response of a session issues the CSRF token next to the session cookie
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, &MockRequest{id: 1, readheader: mockHeader{}})
+	res := &MockAPISIXResponseWriter{resid: 2, statuscode: 200}
+	i.ResponseFilter(cfg, res)
+	var sid, token string
+	for name, values := range res.Header().View() {
+		if strings.EqualFold(name, "Set-Cookie") {
+			if value, ok := cookieValue("sid", values[0]); ok {
+				sid = value
+			}
+			if value, ok := cookieValue("csrf_token", values[0]); ok {
+				token = value
+			}
+		}
+	}
+	if sid == "" || token == "" {
+		t.Fatalf("expected the session cookie and the CSRF token to be issued, found %v", res.Header().View())
+	}
+
+	type testCase struct {
+		name        string
+		description string
+		method      string
+		header      map[string]string
+		vars        map[string][]byte
+		status      int //Status RequestFilter is expected to answer with, 0 when the request goes upstream
+	}
+	testCases := []testCase{
+		{
+			name:        "TestSafeMethod",
+			description: "A GET request should not need the token",
+			method:      http.MethodGet,
+			header:      map[string]string{"Cookie": "sid=" + sid + "; csrf_token=" + token, "Origin": "https://evil.example"},
+		},
+		{
+			name:        "TestMissingToken",
+			description: "A POST request without the token should be rejected",
+			method:      http.MethodPost,
+			header:      map[string]string{"Cookie": "sid=" + sid},
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "TestWrongToken",
+			description: "A DELETE request with another token should be rejected",
+			method:      http.MethodDelete,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": "forged"},
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "TestToken",
+			description: "A PUT request with the token and without Origin or Referer should pass",
+			method:      http.MethodPut,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token},
+		},
+		{
+			name:        "TestSameOrigin",
+			description: "A request from a page of the route's own host should pass",
+			method:      http.MethodPatch,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token, "Host": "shop.example.com", "Origin": "https://shop.example.com"},
+			vars:        map[string][]byte{"scheme": []byte("https")},
+		},
+		{
+			name:        "TestSchemeMismatch",
+			description: "A request from a page of the route's own host over another scheme should be rejected",
+			method:      http.MethodPatch,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token, "Host": "shop.example.com", "Origin": "http://shop.example.com"},
+			vars:        map[string][]byte{"scheme": []byte("https")},
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "TestTrustedOrigin",
+			description: "A request from a trusted origin should pass",
+			method:      http.MethodPost,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token, "Host": "api.example.com", "Origin": "https://app.example.com"},
+		},
+		{
+			name:        "TestCrossOrigin",
+			description: "A request from another origin should be rejected even with the token",
+			method:      http.MethodPost,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token, "Host": "shop.example.com", "Origin": "https://evil.example"},
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "TestRefererFallback",
+			description: "Without Origin, the Referer should be checked",
+			method:      http.MethodPost,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token, "Host": "shop.example.com", "Referer": "https://evil.example/page"},
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "TestOpaqueOrigin",
+			description: "The opaque origin null should be rejected",
+			method:      http.MethodPost,
+			header:      map[string]string{"Cookie": "sid=" + sid, "X-CSRF-Token": token, "Origin": "null"},
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "TestWithoutSession",
+			description: "A request without a session carries nothing to forge and should pass",
+			method:      http.MethodPost,
+			header:      map[string]string{},
+		},
+	}
+	for n, tt := range testCases {
+		w := &MockResponseWriter{responseHeader: make(http.Header)}
+		i.RequestFilter(cfg, w, &MockRequest{id: uint32(10 + 2*n), method: tt.method, readheader: mockHeader{header: tt.header}, vars: tt.vars})
+		if w.statuscode != tt.status {
+			t.Fatalf("%s: %s: expected status %d, found %d", tt.name, tt.description, tt.status, w.statuscode)
+		}
+	}
+	if n := testutil.ToFloat64(i.metrics.csrfRejections); n != 6 {
+		t.Fatalf("expected 6 CSRF rejections to be counted, found %v", n)
+	}
+
+	//The token is only handed out again when the client no longer presents it
+	res = &MockAPISIXResponseWriter{resid: 10 + 2*0 + 1, statuscode: 200}
+	i.ResponseFilter(cfg, res)
+	if len(res.Header().View()) != 0 {
+		t.Fatalf("expected no cookie for the client holding the token, found %v", res.Header().View())
+	}
+	res = &MockAPISIXResponseWriter{resid: 10 + 2*3 + 1, statuscode: 200}
+	i.ResponseFilter(cfg, res)
+	if values := res.Header().View()["Set-Cookie"]; len(values) != 1 || values[0] != "csrf_token="+token+"; Path=/; SameSite=Strict" {
+		t.Fatalf("expected the token to be sent again to the client without the cookie, found %v", res.Header().View())
+	}
+}
+
+func TestCSRFHeaderTransport(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"transport":"header","csrf":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, &MockRequest{id: 1, readheader: mockHeader{}})
+	res := &MockAPISIXResponseWriter{resid: 2, statuscode: 200}
+	i.ResponseFilter(cfg, res)
+	sid, token := res.Header().Get("X-Session-Token"), res.Header().Get("X-CSRF-Token")
+	if sid == "" || token == "" || res.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("expected the session and CSRF tokens in their headers and no cookie, found %v", res.Header().View())
+	}
+	w := &MockResponseWriter{responseHeader: make(http.Header)}
+	i.RequestFilter(cfg, w, &MockRequest{id: 3, method: http.MethodPost, readheader: mockHeader{header: map[string]string{"X-Session-Token": sid, "X-CSRF-Token": token}}})
+	if w.statuscode != 0 {
+		t.Fatalf("expected the request with the token to pass, found status %d", w.statuscode)
+	}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, &MockRequest{id: 5, method: http.MethodGet, readheader: mockHeader{header: map[string]string{"X-Session-Token": sid}}})
+	for _, resid := range []uint32{4, 6} {
+		res = &MockAPISIXResponseWriter{resid: resid, statuscode: 200}
+		i.ResponseFilter(cfg, res)
+		if found, resent := res.Header().Get("X-CSRF-Token"), resid == 6; (found == token) != resent {
+			t.Fatalf("expected the token to be sent again only to the request without it, found %q for response %d", found, resid)
+		}
+	}
+}
+
+func TestFailureCounter(t *testing.T) {
+	type testCase struct {
+		name        string
+		description string
+		policy      FailurePolicy
+		statusCodes []int
+		gaps        []time.Duration //Time elapsed before each response
+		tripped     bool            //Whether the policy should have tripped on the last response
+	}
+	testCases := []testCase{
+		{
+			name:        "TestTotalMode",
+			description: "Failures keep counting across successful responses",
+			policy:      FailurePolicy{Limit: 3},
+			statusCodes: []int{500, 200, 404, 200, 503},
+			tripped:     true,
+		},
+		{
+			name:        "TestConsecutiveMode",
+			description: "A successful response resets the count",
+			policy:      FailurePolicy{Limit: 3, Mode: failureModeConsecutive},
+			statusCodes: []int{500, 500, 200, 500, 500},
+			tripped:     false,
+		},
+		{
+			name:        "TestStatusCodes",
+			description: "Only the configured status codes are counted",
+			policy:      FailurePolicy{Limit: 2, StatusCodes: []int{429}},
+			statusCodes: []int{429, 500, 404, 429},
+			tripped:     true,
+		},
+		{
+			name:        "TestSlidingWindow",
+			description: "Failures older than the window should not count towards the limit",
+			policy:      FailurePolicy{Limit: 3, WindowInSeconds: 60},
+			statusCodes: []int{500, 500, 500},
+			gaps:        []time.Duration{0, 50 * time.Second, 50 * time.Second},
+			tripped:     false,
+		},
+		{
+			name:        "TestSlidingWindowSlides",
+			description: "Once old failures fall out of the window, recent ones still trip the policy",
+			policy:      FailurePolicy{Limit: 3, WindowInSeconds: 60},
+			statusCodes: []int{500, 500, 500, 500},
+			gaps:        []time.Duration{0, 50 * time.Second, 5 * time.Second, 5 * time.Second},
+			tripped:     true,
+		},
+	}
+
+	for _, tt := range testCases {
+		var f failureCounter
+		now := time.Now()
+		var tripped bool
+		for j, code := range tt.statusCodes {
+			if j < len(tt.gaps) {
+				now = now.Add(tt.gaps[j])
+			}
+			tripped = f.record(code, tt.policy, now)
+		}
+		if tripped != tt.tripped {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:expected tripped=%t, found %t\n", tt.name, tt.description, tt.tripped, tripped))
+		}
+	}
+}
+
+func TestFailureCounterSize(t *testing.T) {
+	now := time.Now()
+	var f failureCounter
+	for n := 0; n < 3; n++ {
+		f.record(500, FailurePolicy{Limit: 1000}, now)
+	}
+	if f.failures != nil || f.count != 3 {
+		t.Fatalf("expected a plain count of 3 without a window, found %d timestamps and count %d", len(f.failures), f.count)
+	}
+	f = failureCounter{}
+	policy := FailurePolicy{Limit: 1000, WindowInSeconds: 60}
+	for n := 0; n < 10; n++ {
+		f.record(500, policy, now.Add(time.Duration(n)*time.Second))
+	}
+	if len(f.failures) != 16 || f.count != 10 {
+		t.Fatalf("expected the buffer to grow with the 10 failures rather than to the limit, found %d slots for %d failures", len(f.failures), f.count)
+	}
+	f.record(500, policy, now.Add(10*time.Minute))
+	if len(f.failures) != 16 || f.count != 1 {
+		t.Fatalf("expected the failures out of the window to be dropped, found %d", f.count)
+	}
+}
+
+func TestCircuitBreakerResponse(t *testing.T) {
+	cfg := Config{
+		CookieName:     "test-id",
+		FailurePolicy:  &FailurePolicy{Limit: 2},
+		CircuitBreaker: &CircuitBreaker{CoolDownInSeconds: 30},
+	}
+	sess := &session{sessionID: "xyz"}
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	seed(i, map[string]*session{"xyz": sess}, map[uint32]*session{1: sess, 2: sess, 3: sess, 4: sess, 5: sess})
+
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 2, statuscode: 500})
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 3, statuscode: 500})
+	if sess.breaker.state != breakerOpen || i.getSession("xyz") == nil {
+		t.Fatalf("expected the breaker to open and the session to be kept")
+	}
+	sess.breaker.allow(*cfg.CircuitBreaker, time.Now().Add(time.Minute), 4) //Emulate RequestFilter letting request 4 through as the probe
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 4, statuscode: 200})
+	if sess.breaker.state != breakerHalfOpen {
+		t.Fatalf("expected the late response of a request sent before the breaker opened to leave it half-open, found %s", sess.breaker)
+	}
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 5, statuscode: 500})
+	if sess.breaker.state != breakerOpen {
+		t.Fatalf("expected a failed probe to re-open the breaker")
+	}
+	sess.breaker.allow(*cfg.CircuitBreaker, time.Now().Add(time.Minute), 5)
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 6, statuscode: 200})
+	if sess.breaker.state != breakerClosed {
+		t.Fatalf("expected a successful probe to close the breaker")
+	}
+}
+
+func TestStickyUpstreamPinning(t *testing.T) {
+	cfg := Config{
+		CookieName:     "test-id",
+		StickyUpstream: true,
+	}
+	sess := &session{sessionID: "xyz"}
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	seed(i, map[string]*session{"xyz": sess}, map[uint32]*session{1: sess, 2: sess})
+
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 2, statuscode: 200, vars: map[string][]byte{
+		"upstream_addr": []byte("10.0.0.1:80, 10.0.0.2:80"), //APISIX retried on a second node
+	}})
+	if sess.upstream != "10.0.0.2:80" {
+		t.Fatalf("expected the session to be pinned to the node which answered, found %q", sess.upstream)
+	}
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 3, statuscode: 502, vars: map[string][]byte{
+		"upstream_addr": []byte("10.0.0.2:80"),
+	}})
+	if sess.upstream != "" {
+		t.Fatalf("expected a 5xx from the pinned node to drop the pin, found %q", sess.upstream)
+	}
+}
+
+func TestStickyFailoverRepinning(t *testing.T) {
+	cfg := Config{
+		CookieName:         "test-id",
+		StickyUpstream:     true,
+		StickyFailureLimit: 2,
+	}
+	sess := &session{sessionID: "xyz", upstream: "10.0.0.1:80", customKeyValue: "auth-one"}
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	seed(i, map[string]*session{"xyz": sess}, map[uint32]*session{1: sess, 2: sess, 3: sess})
+	pinned := map[string][]byte{"upstream_addr": []byte("10.0.0.1:80")}
+
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 2, statuscode: 503, vars: pinned})
+	if sess.upstream != "10.0.0.1:80" {
+		t.Fatalf("expected the pin to be kept below stickyFailureLimit")
+	}
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 3, statuscode: 503, vars: pinned})
+	if sess.upstream != "" {
+		t.Fatalf("expected the pin to be dropped once stickyFailureLimit is reached")
+	}
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 4, statuscode: 200, vars: map[string][]byte{"upstream_addr": []byte("10.0.0.2:80")}})
+	if sess.upstream != "10.0.0.2:80" {
+		t.Fatalf("expected the session to be re-pinned to the new node, found %q", sess.upstream)
+	}
+	if i.getSession("xyz") == nil || sess.customKeyValue != "auth-one" {
+		t.Fatalf("expected re-pinning to keep the session and its authentication")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := Config{
+		CookieName:    "test-id",
+		CustomKeyAuth: "auth-one",
+		FailurePolicy: &FailurePolicy{Limit: 1},
+	}
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	req := &MockRequest{readheader: mockHeader{header: make(map[string]string)}}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req) //No key, so the request is rejected
+	if n := testutil.ToFloat64(i.metrics.sessionsCreated); n != 1 {
+		t.Fatalf("expected 1 created session, found %v", n)
+	}
+	if n := testutil.ToFloat64(i.metrics.authRejections); n != 1 {
+		t.Fatalf("expected 1 auth rejection, found %v", n)
+	}
+
+	i.store.addRequest(1, &pendingRequest{sess: i.store.sessions()[0]})
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 2, statuscode: 500})
+	if n := testutil.ToFloat64(i.metrics.sessionsRemoved.WithLabelValues(reasonFailureLimit)); n != 1 {
+		t.Fatalf("expected 1 session removed due to %s, found %v", reasonFailureLimit, n)
+	}
+	if n, err := testutil.GatherAndCount(i.metrics.registry, "session_manager_active_sessions"); err != nil || n != 1 {
+		t.Fatalf("expected the active sessions gauge to be exposed, found %d series (%v)", n, err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, WithTracerProvider(tp))
+	cfg := Config{
+		CookieName:    "test-id",
+		CustomKeyAuth: "auth-one",
+	}
+	req := &MockRequest{id: 1, readheader: mockHeader{header: map[string]string{
+		"apiKey":      "auth-one",
+		"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}}}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 2, statuscode: 200}) //No http_traceparent var, the trace context comes from the request
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, found %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.Parent.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("expected %s to continue the incoming trace, found trace %s", span.Name, span.Parent.TraceID())
+		}
+	}
+	span := spans[0]
+	attrs := make(map[string]string)
+	for _, attr := range span.Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["session.new"] != "true" || attrs["session.auth"] != authAccepted || attrs["session.id_hash"] == "" {
+		t.Fatalf("unexpected span attributes: %v", attrs)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.snapshot")
+	key := bytes.Repeat([]byte{7}, 32)
+	now := time.Now()
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	seed(i, map[string]*session{
+		"forever": {sessionID: "forever", customKeyValue: "auth-one", cohort: "canary", createdAt: now},
+		"later":   {sessionID: "later", upstream: "10.0.0.1:80", createdAt: now, expiresAt: now.Add(time.Hour)},
+		"expired": {sessionID: "expired", createdAt: now, expiresAt: now.Add(-time.Second)},
+		"tripped": {sessionID: "tripped", createdAt: now, breaker: breakerState{state: breakerOpen, openedAt: now}},
+	}, nil)
+
+	type testCase struct {
+		name        string
+		description string
+		writeKey    []byte
+		readKey     []byte
+		restored    int
+	}
+	testCases := []testCase{
+		{
+			name:        "TestEncrypted",
+			description: "Live sessions should survive a restart with the same key",
+			writeKey:    key,
+			readKey:     key,
+			restored:    3,
+		},
+		{
+			name:        "TestPlain",
+			description: "Snapshots can be written without encryption",
+			restored:    3,
+		},
+		{
+			name:        "TestWrongKey",
+			description: "A snapshot which cannot be decrypted should be skipped",
+			writeKey:    key,
+			readKey:     bytes.Repeat([]byte{8}, 32),
+		},
+		{
+			name:        "TestMissingKey",
+			description: "An encrypted snapshot should not be read as plain JSON",
+			writeKey:    key,
+		},
+	}
+	for _, tt := range testCases {
+		if err := i.WriteSnapshot(path, tt.writeKey); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := ioutil.ReadFile(path)
+		if tt.writeKey != nil && bytes.Contains(raw, []byte("auth-one")) {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:API key found in the encrypted snapshot\n", tt.name, tt.description))
+		}
+		restored := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, WithSnapshot(path, tt.readKey))
+		if n := restored.store.sessionCount(); n != tt.restored {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:expected %d sessions, found %d\n", tt.name, tt.description, tt.restored, n))
+		}
+		if tt.restored == 0 {
+			continue
+		}
+		if s := restored.getSession("forever"); s.customKeyValue != "auth-one" || s.cohort != "canary" || !s.expiresAt.IsZero() {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:session not restored as it was: %+v\n", tt.name, tt.description, s))
+		}
+		if s := restored.getSession("later"); s.upstream != "10.0.0.1:80" || !s.expiresAt.Equal(now.Add(time.Hour)) {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:lifetime not restored: %+v\n", tt.name, tt.description, s))
+		}
+		if s := restored.getSession("tripped"); s.breaker.state != breakerOpen {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:circuit breaker not restored: %s\n", tt.name, tt.description, s.breaker))
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatal(fmt.Printf("Name: %s\nDescription:%s\nReason:restored snapshot not removed\n", tt.name, tt.description))
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	seed(i, map[string]*session{"xyz": {sessionID: "xyz"}}, nil)
+	i.Drain(time.Second)
+	cfg := Config{CookieName: "test-id"}
+
+	res := &MockResponseWriter{responseHeader: make(http.Header)}
+	i.RequestFilter(cfg, res, &MockRequest{readheader: mockHeader{header: map[string]string{}}})
+	if n := i.store.sessionCount(); res.statuscode != http.StatusServiceUnavailable || n != 1 {
+		t.Fatalf("expected new sessions to be refused while draining, found status %d and %d sessions", res.statuscode, n)
+	}
+	res = &MockResponseWriter{responseHeader: make(http.Header)}
+	i.RequestFilter(cfg, res, &MockRequest{readheader: mockHeader{header: map[string]string{"Cookie": "test-id=xyz"}}})
+	if res.statuscode != 0 {
+		t.Fatalf("expected existing sessions to be served while draining, found status %d", res.statuscode)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var out, logs bytes.Buffer
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(&logs)}, WithAuditOutput(zapcore.AddSync(&out)))
+	cfg := Config{
+		CookieName:    "test-id",
+		CustomKeyAuth: "auth-one",
+	}
+	req := &MockRequest{
+		readheader: mockHeader{header: map[string]string{
+			"Cookie": "test-id=expired",
+			"apiKey": "wrong-key",
+		}},
+		srcip: net.ParseIP("10.1.2.3"),
+	}
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+	var sids []string
+	for _, sess := range i.store.sessions() {
+		sids = append(sids, sess.sessionID)
+		i.removeSession(sess.sessionID, reasonTimeout)
+	}
+
+	if strings.Contains(out.String(), "wrong-key") || strings.Contains(out.String(), "expired") {
+		t.Fatalf("secrets leaked into the audit log: %s", out.String())
+	}
+	for _, sid := range sids {
+		if strings.Contains(logs.String(), sid) {
+			t.Fatalf("session ID leaked into the plugin log: %s", logs.String())
+		}
+	}
+	key := WithFingerprintKey([]byte("runner-key"))
+	a, b := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, key), New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, key)
+	if a.fingerprint("auth-one") != b.fingerprint("auth-one") || a.fingerprint("auth-one") == i.fingerprint("auth-one") {
+		t.Fatal("expected fingerprints to match between runners sharing the key only")
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("audit entry is not JSON: %s", line)
+		}
+		if entry["session"] == "" {
+			t.Fatalf("audit entry without session: %s", line)
+		}
+		events = append(events, entry["event"].(string))
+		if entry["event"] == auditSessionRejected && entry["source_ip"] != "10.1.2.3" {
+			t.Fatalf("expected source_ip 10.1.2.3, found %v", entry["source_ip"])
+		}
+	}
+	expected := []string{auditSessionCreated, auditSessionRotated, auditSessionRejected, auditSessionDestroyed}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v, found %v", expected, events)
+	}
+}
+
+// func BenchmarkResponseFilter(b *testing.B) {
+
+// }
+
+func TestCohortDrawSeeded(t *testing.T) {
+	unseeded := rand.New(rand.NewSource(1)) //What the global source of math/rand draws before go1.20 unless seeded
+	same := 0
+	for n := 0; n < 10; n++ {
+		cohortRand.Lock()
+		drawn := cohortRand.Int63()
+		cohortRand.Unlock()
+		if drawn == unseeded.Int63() {
+			same++
+		}
+	}
+	if same == 10 {
+		t.Fatal("expected the cohorts to be drawn from a seeded source rather than the same sequence on every start")
+	}
+}
@@ -0,0 +1,107 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Settings are the runner level settings which can be changed while the runner is serving, without touching the stored sessions
+type Settings struct {
+	LogLevel                   zapcore.Level
+	RouteDefaults              []byte            //Config every route inherits. Route configs are merged over it key by key before being parsed
+	Secrets                    map[string]string //Named secrets routes can refer to instead of carrying the secret in their config, e.g. customKeyAuthSecret
+	AdminToken                 string            //Token required by the admin API served by ServeAdmin
+	MaxSessions                int               //See SetSessionLimits
+	MaxUnauthenticatedSessions int
+}
+
+// ApplySettings swaps in the route defaults, secrets and admin token all at once, so that no request sees a mix of the old and new ones.
+// The log level and session limits are applied right after, on their own. Nothing is changed when the settings are invalid.
+// Route defaults only apply to route configs parsed afterwards, APISIX keeps using the configs it already parsed until the route changes.
+func (i *Instance) ApplySettings(s Settings) error {
+	defaults, err := parseRouteDefaults(s.RouteDefaults)
+	if err != nil {
+		return err
+	}
+	i.confMx.Lock()
+	i.routeDefaults = defaults
+	i.secrets = s.Secrets
+	i.adminToken = s.AdminToken
+	i.confMx.Unlock()
+	if i.logLevel.Level() != s.LogLevel {
+		i.log.Info("Changing log level from ", i.logLevel.Level(), " to ", s.LogLevel)
+		i.logLevel.SetLevel(s.LogLevel)
+	}
+	i.SetSessionLimits(s.MaxSessions, s.MaxUnauthenticatedSessions)
+	return nil
+}
+
+func parseRouteDefaults(raw []byte) (map[string]json.RawMessage, error) {
+	var defaults map[string]json.RawMessage
+	if len(raw) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&Config{}); err != nil { //The merged config is validated in ParseConf, this only catches typos early
+			return nil, fmt.Errorf("invalid route defaults: %w", err)
+		}
+		if err := json.Unmarshal(raw, &defaults); err != nil {
+			return nil, fmt.Errorf("invalid route defaults: %w", err)
+		}
+	}
+	return defaults, nil
+}
+
+// withRouteDefaults merges a route config over the route defaults. Configs which are not JSON objects are returned as is for the schema to reject.
+func (i *Instance) withRouteDefaults(in []byte) []byte {
+	i.confMx.RLock()
+	defaults := i.routeDefaults
+	i.confMx.RUnlock()
+	if len(defaults) == 0 {
+		return in
+	}
+	var route map[string]json.RawMessage
+	if err := json.Unmarshal(in, &route); err != nil || route == nil {
+		return in
+	}
+	merged := make(map[string]json.RawMessage, len(defaults)+len(route))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range route {
+		merged[k] = v
+	}
+	out, err := json.Marshal(merged)
+	if err != nil {
+		return in
+	}
+	return out
+}
+
+func (i *Instance) secret(name string) (string, bool) {
+	i.confMx.RLock()
+	defer i.confMx.RUnlock()
+	s, ok := i.secrets[name]
+	return s, ok
+}
+
+func (c Config) customKeyAuthEnabled() bool {
+	return c.CustomKeyAuth != "" || c.CustomKeyAuthSecret != ""
+}
+
+// customKey is the key expected by the custom key auth of a route, looked up on every request so that rotated secrets apply right away
+func (i *Instance) customKey(c Config) string {
+	if c.CustomKeyAuthSecret != "" {
+		s, _ := i.secret(c.CustomKeyAuthSecret)
+		return s
+	}
+	return c.CustomKeyAuth
+}
+
+func (i *Instance) currentAdminToken() string {
+	i.confMx.RLock()
+	defer i.confMx.RUnlock()
+	return i.adminToken
+}
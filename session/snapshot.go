@@ -0,0 +1,233 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Encrypted snapshots start with snapshotMagic, followed by the AES-GCM nonce and the sealed JSON. Plain snapshots are JSON.
+const snapshotMagic = "session-manager-snapshot-v1\n"
+
+const snapshotVersion = 1
+
+// snapshot is what is written on shutdown. It holds API keys, so it should be encrypted unless the disk is trusted.
+type snapshot struct {
+	Version  int               `json:"version"`
+	TakenAt  time.Time         `json:"takenAt"`
+	Sessions []snapshotSession `json:"sessions"`
+}
+
+type snapshotSession struct {
+	ID             string     `json:"id"`
+	APIKey         string     `json:"apiKey,omitempty"`
+	CustomKey      string     `json:"customKey,omitempty"`
+	Upstream       string     `json:"upstream,omitempty"`
+	Cohort         string     `json:"cohort,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastSeen       time.Time  `json:"lastSeen"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`     //Absent for sessions without timeout, the remaining lifetime keeps running while the runner is down
+	BreakerOpenAt  *time.Time `json:"breakerOpenAt,omitempty"` //Set while the circuit breaker of the session is not closed
+	UpstreamErrors int        `json:"upstreamErrors,omitempty"`
+	Authenticated  bool       `json:"authenticated,omitempty"`
+	CSRFToken      string     `json:"csrfToken,omitempty"`
+}
+
+// WithSnapshot restores the sessions of the snapshot at path, as written by WriteSnapshot, when the instance is created.
+// key decrypts the snapshot and must be the key it was written with, or nil for plain snapshots. A missing snapshot is not an error,
+// an unreadable one is logged and skipped so that the runner still starts. The snapshot is removed once restored, so that sessions revoked
+// afterwards cannot come back from it.
+func WithSnapshot(path string, key []byte) Option {
+	return func(i *Instance) {
+		i.snapshotPath = path
+		i.snapshotKey = key
+	}
+}
+
+func (i *Instance) restoreSnapshot() {
+	raw, err := ioutil.ReadFile(i.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		i.log.Error("Failed to read session snapshot: ", err.Error())
+		return
+	}
+	snap, err := decodeSnapshot(raw, i.snapshotKey)
+	if err != nil {
+		i.log.Error("Failed to restore session snapshot ", i.snapshotPath, ": ", err.Error())
+		return
+	}
+	now := time.Now()
+	restored := 0
+	for _, s := range snap.Sessions {
+		sess := &session{
+			sessionID:        s.ID,
+			apiKeyValue:      s.APIKey,
+			customKeyValue:   s.CustomKey,
+			upstream:         s.Upstream,
+			upstreamFailures: s.UpstreamErrors,
+			cohort:           s.Cohort,
+			authenticated:    s.Authenticated,
+			csrfToken:        s.CSRFToken,
+			createdAt:        s.CreatedAt,
+			lastSeen:         s.LastSeen,
+		}
+		if s.BreakerOpenAt != nil {
+			sess.breaker.open(*s.BreakerOpenAt)
+		}
+		if s.ExpiresAt != nil {
+			if !s.ExpiresAt.After(now) {
+				continue
+			}
+			sess.expiresAt = *s.ExpiresAt
+		}
+		i.addSession(sess)
+		if !sess.expiresAt.IsZero() {
+			i.expireAfter(sess)
+		}
+		restored++
+	}
+	if err := os.Remove(i.snapshotPath); err != nil {
+		i.log.Error("Failed to remove restored session snapshot: ", err.Error())
+	}
+	i.log.Info("Restored ", restored, " of ", len(snap.Sessions), " sessions from the snapshot taken at ", snap.TakenAt.Format(time.RFC3339))
+}
+
+// Drain stops the creation of sessions, as they would not make it into the snapshot, and waits up to timeout for the filter calls in flight to finish.
+// Requests which would need a new session are answered with 503 from then on.
+func (i *Instance) Drain(timeout time.Duration) {
+	i.draining.Store(true)
+	deadline := time.Now().Add(timeout)
+	for i.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	i.log.Info("Drained with ", i.inFlight.Load(), " filter calls still in flight")
+}
+
+// WriteSnapshot writes the live sessions to path, encrypted with AES-GCM when key is not nil. key must be 16, 24 or 32 bytes long.
+// The file is replaced atomically and only readable by its owner.
+func (i *Instance) WriteSnapshot(path string, key []byte) error {
+	snap := snapshot{Version: snapshotVersion, TakenAt: time.Now()}
+	for _, s := range i.listSessions() {
+		if !s.expiresAt.IsZero() && !s.expiresAt.After(snap.TakenAt) {
+			continue
+		}
+		s.mx.Lock()
+		v := snapshotSession{
+			ID:             s.sessionID,
+			APIKey:         s.apiKeyValue,
+			CustomKey:      s.customKeyValue,
+			Upstream:       s.upstream,
+			UpstreamErrors: s.upstreamFailures,
+			Cohort:         s.cohort,
+			Authenticated:  s.authenticated,
+			CSRFToken:      s.csrfToken,
+			CreatedAt:      s.createdAt,
+			LastSeen:       s.lastSeen,
+		}
+		if s.breaker.state != breakerClosed { //A probe in flight is lost with the runner, the next one is allowed after the cool-down
+			openedAt := s.breaker.openedAt
+			v.BreakerOpenAt = &openedAt
+		}
+		s.mx.Unlock()
+		if !s.expiresAt.IsZero() {
+			expiresAt := s.expiresAt
+			v.ExpiresAt = &expiresAt
+		}
+		snap.Sessions = append(snap.Sessions, v)
+	}
+	raw, err := encodeSnapshot(snap, key)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".session-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //Fails harmlessly once renamed
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	i.log.Info("Wrote ", len(snap.Sessions), " sessions to snapshot ", path)
+	return nil
+}
+
+func encodeSnapshot(snap snapshot, key []byte) ([]byte, error) {
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return raw, nil
+	}
+	gcm, err := newSnapshotCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(snapshotMagic), nonce...)
+	return gcm.Seal(out, nonce, raw, []byte(snapshotMagic)), nil
+}
+
+func decodeSnapshot(raw []byte, key []byte) (snapshot, error) {
+	var snap snapshot
+	encrypted := bytes.HasPrefix(raw, []byte(snapshotMagic))
+	switch {
+	case encrypted && key == nil:
+		return snap, errors.New("snapshot is encrypted but no key is configured")
+	case !encrypted && key != nil:
+		return snap, errors.New("snapshot is not encrypted but a key is configured")
+	case encrypted:
+		gcm, err := newSnapshotCipher(key)
+		if err != nil {
+			return snap, err
+		}
+		raw = raw[len(snapshotMagic):]
+		if len(raw) < gcm.NonceSize() {
+			return snap, errors.New("snapshot is truncated")
+		}
+		raw, err = gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], []byte(snapshotMagic))
+		if err != nil {
+			return snap, errors.New("snapshot cannot be decrypted with the configured key")
+		}
+	}
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return snap, err
+	}
+	if snap.Version != snapshotVersion {
+		return snap, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	return snap, nil
+}
+
+func newSnapshotCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
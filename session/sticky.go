@@ -0,0 +1,66 @@
+package session
+
+import (
+	"strings"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+)
+
+const defaultUpstreamHintHeader = "X-Session-Upstream"
+
+func (c Config) upstreamHintHeader() string {
+	if c.UpstreamHintHeader != "" {
+		return c.UpstreamHintHeader
+	}
+	return defaultUpstreamHintHeader
+}
+
+// servedBy returns the upstream node which served the response. When APISIX retried the request, upstream_addr holds every attempted node
+// separated by ", " and the last one is the node that actually answered.
+func servedBy(w apisixHTTP.Response) string {
+	addr, err := w.Var("upstream_addr")
+	if err != nil || len(addr) == 0 {
+		return ""
+	}
+	addrs := strings.Split(string(addr), ",")
+	return strings.TrimSpace(addrs[len(addrs)-1])
+}
+
+func (c Config) stickyFailureLimit() int {
+	if c.StickyFailureLimit > 0 {
+		return c.StickyFailureLimit
+	}
+	return 1
+}
+
+// pinUpstream records the node which served a response in the session. After stickyFailureLimit 5xx responses in a row from the pinned node
+// the pin is dropped, so that the next successful response re-pins the session to whichever node the balancer picks instead. Only the pin is
+// reset, authentication and all other session data are kept.
+func (i *Instance) pinUpstream(config Config, sess *session, addr string, statusCode int) {
+	if addr == "" {
+		return
+	}
+	if statusCode >= 500 {
+		if addr != sess.upstream {
+			return
+		}
+		sess.upstreamFailures++
+		if sess.upstreamFailures >= config.stickyFailureLimit() {
+			i.log.Info("Unpinned session: ", i.fingerprint(sess.sessionID), " from failing upstream ", addr, " after ", sess.upstreamFailures, " failures")
+			sess.upstream = ""
+			sess.upstreamFailures = 0
+		}
+		return
+	}
+	sess.upstream = addr
+	sess.upstreamFailures = 0
+}
+
+// setUpstreamHint tells APISIX which node the session is pinned to. Any hint sent by the client itself is dropped so that it cannot pick a node.
+func setUpstreamHint(config Config, sess *session, r apisixHTTP.Request) {
+	if sess.upstream == "" {
+		r.Header().Del(config.upstreamHintHeader())
+		return
+	}
+	r.Header().Set(config.upstreamHintHeader(), sess.upstream)
+}
@@ -0,0 +1,336 @@
+package session
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of shards of the store unless set with WithStoreShards
+const defaultStoreShards = 32
+
+// Time a request is kept for its response unless set with WithPendingRequestTTL
+const defaultPendingRequestTTL = 5 * time.Minute
+
+// store keeps the sessions and the requests on their way to the upstream in maps split into shards, each with its own lock,
+// so that concurrent requests of different sessions rarely wait on each other.
+// When limited, the store holds at most maxSessions sessions in all and evicts the least recently used ones beyond it, going by the
+// recency kept per shard.
+type store struct {
+	sessionShards      []sessionShard
+	requestShards      []requestShard
+	maxSessions        atomic.Int64 //0 when unlimited, see setLimits
+	maxUnauthenticated atomic.Int64 //0 when unlimited
+	count              atomic.Int64 //Stored sessions
+	unauthenticated    atomic.Int64 //Stored sessions which are not authenticated
+	requestTTL         time.Duration
+}
+
+type sessionShard struct {
+	mx              sync.RWMutex
+	sessions        map[string]*list.Element //key is a stringified UUID of the session, values are *storedSession in one of the lists below
+	authenticated   *list.List               //Most recently used first
+	unauthenticated *list.List               //Most recently used first
+}
+
+type storedSession struct {
+	sess          *session
+	authenticated bool
+}
+
+type requestShard struct {
+	mx        sync.RWMutex
+	requests  map[uint32]*pendingRequest
+	lastSweep time.Time
+}
+
+// WithStoreShards sets the number of shards of the session store. A single shard behaves like one map behind one lock.
+func WithStoreShards(n int) Option {
+	return func(i *Instance) {
+		if n > 0 {
+			i.storeShards = n
+		}
+	}
+}
+
+// WithMaxSessions bounds the number of stored sessions. Beyond maxSessions, the least recently used session is evicted,
+// unauthenticated ones first. Unauthenticated sessions, i.e. sessions none of whose requests passed the auth, are evicted beyond
+// maxUnauthenticated already, so that a flood of requests without cookie cannot push out the sessions of authenticated clients.
+// 0 leaves the respective number unbounded. The limits can be changed later with SetSessionLimits.
+func WithMaxSessions(maxSessions int, maxUnauthenticated int) Option {
+	return func(i *Instance) {
+		i.maxSessions = maxSessions
+		i.maxUnauthenticatedSessions = maxUnauthenticated
+	}
+}
+
+// WithPendingRequestTTL sets how long a request is kept for ResponseFilter. APISIX does not call ResponseFilter for requests it ends before
+// the upstream answers, e.g. when a later plugin rejects them or the client goes away, so such requests are forgotten after ttl.
+// Responses taking longer than ttl are passed on without the session, i.e. neither counted by the failure policy nor given a new session.
+func WithPendingRequestTTL(ttl time.Duration) Option {
+	return func(i *Instance) {
+		if ttl > 0 {
+			i.pendingRequestTTL = ttl
+		}
+	}
+}
+
+// SetSessionLimits changes the limits of WithMaxSessions while serving. Sessions beyond lowered limits are evicted right away.
+func (i *Instance) SetSessionLimits(maxSessions int, maxUnauthenticated int) {
+	if int64(maxSessions) == i.store.maxSessions.Load() && int64(maxUnauthenticated) == i.store.maxUnauthenticated.Load() {
+		return
+	}
+	i.log.Info("Changing session limits to ", maxSessions, " sessions and ", maxUnauthenticated, " unauthenticated sessions")
+	i.store.setLimits(maxSessions, maxUnauthenticated)
+	for _, evicted := range i.store.evict(0, nil) {
+		i.cleanUpSession(evicted, reasonEvicted)
+	}
+}
+
+func newStore(shards int, maxSessions int, maxUnauthenticated int, requestTTL time.Duration) *store {
+	s := &store{
+		sessionShards: make([]sessionShard, shards),
+		requestShards: make([]requestShard, shards),
+		requestTTL:    requestTTL,
+	}
+	for n := range s.sessionShards {
+		s.sessionShards[n].sessions = make(map[string]*list.Element)
+		s.sessionShards[n].authenticated = list.New()
+		s.sessionShards[n].unauthenticated = list.New()
+		s.requestShards[n].requests = make(map[uint32]*pendingRequest)
+	}
+	s.setLimits(maxSessions, maxUnauthenticated)
+	return s
+}
+
+func (s *store) setLimits(maxSessions int, maxUnauthenticated int) {
+	s.maxSessions.Store(int64(maxSessions))
+	s.maxUnauthenticated.Store(int64(maxUnauthenticated))
+}
+
+func (s *store) limited() bool {
+	return s.maxSessions.Load() > 0 || s.maxUnauthenticated.Load() > 0
+}
+
+func (s *store) sessionShardIndex(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(s.sessionShards)))
+}
+
+func (s *store) sessionShard(id string) *sessionShard {
+	return &s.sessionShards[s.sessionShardIndex(id)]
+}
+
+func (s *store) requestShard(id uint32) *requestShard {
+	return &s.requestShards[(id*2654435761)%uint32(len(s.requestShards))] //Request IDs are sequential, Knuth's multiplicative hash spreads them
+}
+
+func (shard *sessionShard) list(authenticated bool) *list.List {
+	if authenticated {
+		return shard.authenticated
+	}
+	return shard.unauthenticated
+}
+
+// insert stores the session in the shard as the most recently used one. The caller must hold shard.mx for writing.
+func (s *store) insert(shard *sessionShard, sess *session, authenticated bool) {
+	shard.sessions[sess.sessionID] = shard.list(authenticated).PushFront(&storedSession{sess: sess, authenticated: authenticated})
+	s.count.Add(1)
+	if !authenticated {
+		s.unauthenticated.Add(1)
+	}
+}
+
+// remove drops the session of e from the shard. The caller must hold shard.mx for writing.
+func (s *store) remove(shard *sessionShard, e *list.Element) *session {
+	stored := e.Value.(*storedSession)
+	shard.list(stored.authenticated).Remove(e)
+	delete(shard.sessions, stored.sess.sessionID)
+	s.count.Add(-1)
+	if !stored.authenticated {
+		s.unauthenticated.Add(-1)
+	}
+	return stored.sess
+}
+
+// session looks the session up and, when the store is limited, marks it as the most recently used one
+func (s *store) session(id string) *session {
+	shard := s.sessionShard(id)
+	if !s.limited() {
+		shard.mx.RLock()
+		defer shard.mx.RUnlock()
+		if e, ok := shard.sessions[id]; ok {
+			return e.Value.(*storedSession).sess
+		}
+		return nil
+	}
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	e, ok := shard.sessions[id]
+	if !ok {
+		return nil
+	}
+	stored := e.Value.(*storedSession)
+	shard.list(stored.authenticated).MoveToFront(e)
+	return stored.sess
+}
+
+// addSession stores the session as the most recently used one and returns the sessions evicted to make room for it
+func (s *store) addSession(sess *session, authenticated bool) []*session {
+	n := s.sessionShardIndex(sess.sessionID)
+	shard := &s.sessionShards[n]
+	shard.mx.Lock()
+	if e, ok := shard.sessions[sess.sessionID]; ok {
+		s.remove(shard, e)
+	}
+	s.insert(shard, sess, authenticated)
+	shard.mx.Unlock()
+	return s.evict(n, sess)
+}
+
+// evict removes sessions until the store is within its limits and returns them. Sessions are taken from the shard at index first,
+// so that the least recently used session of the shard the store grew in goes, and from the other shards when it has none to spare.
+// keep is never evicted.
+func (s *store) evict(first int, keep *session) []*session {
+	var evicted []*session
+	for max := s.maxUnauthenticated.Load(); max > 0 && s.unauthenticated.Load() > max; {
+		oldest := s.evictOldest(first, keep, false)
+		if oldest == nil {
+			break
+		}
+		evicted = append(evicted, oldest)
+	}
+	for max := s.maxSessions.Load(); max > 0 && s.count.Load() > max; {
+		oldest := s.evictOldest(first, keep, false)
+		if oldest == nil {
+			oldest = s.evictOldest(first, keep, true)
+		}
+		if oldest == nil {
+			break
+		}
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+// evictOldest removes the least recently used session of the authenticated or unauthenticated ones, locking one shard at a time
+func (s *store) evictOldest(first int, keep *session, authenticated bool) *session {
+	for n := range s.sessionShards {
+		shard := &s.sessionShards[(first+n)%len(s.sessionShards)]
+		shard.mx.Lock()
+		e := shard.list(authenticated).Back()
+		if e != nil && e.Value.(*storedSession).sess == keep {
+			e = e.Prev()
+		}
+		var oldest *session
+		if e != nil {
+			oldest = s.remove(shard, e)
+		}
+		shard.mx.Unlock()
+		if oldest != nil {
+			return oldest
+		}
+	}
+	return nil
+}
+
+// authenticate moves the session over to the authenticated sessions, if it is still stored
+func (s *store) authenticate(id string) {
+	shard := s.sessionShard(id)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	e, ok := shard.sessions[id]
+	if !ok || e.Value.(*storedSession).authenticated {
+		return
+	}
+	s.insert(shard, s.remove(shard, e), true)
+}
+
+// removeSession returns the removed session, or nil when there was none. Of concurrent removals of a session, only one gets it.
+func (s *store) removeSession(id string) *session {
+	shard := s.sessionShard(id)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	e, ok := shard.sessions[id]
+	if !ok {
+		return nil
+	}
+	return s.remove(shard, e)
+}
+
+// sessions returns every stored session, locking one shard at a time
+func (s *store) sessions() []*session {
+	var sessions []*session
+	for n := range s.sessionShards {
+		shard := &s.sessionShards[n]
+		shard.mx.RLock()
+		for _, e := range shard.sessions {
+			sessions = append(sessions, e.Value.(*storedSession).sess)
+		}
+		shard.mx.RUnlock()
+	}
+	return sessions
+}
+
+func (s *store) sessionCount() int {
+	return int(s.count.Load())
+}
+
+func (s *store) request(id uint32) *pendingRequest {
+	shard := s.requestShard(id)
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+	return shard.requests[id]
+}
+
+// addRequest keeps the request until its response takes it. Requests of the shard pending for longer than the TTL are swept along,
+// at most twice per TTL, so that requests whose response never comes are held for 1.5 TTL at most.
+func (s *store) addRequest(id uint32, p *pendingRequest) {
+	now := time.Now()
+	p.addedAt = now
+	shard := s.requestShard(id)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	if now.Sub(shard.lastSweep) > s.requestTTL/2 {
+		for pendingID, pending := range shard.requests {
+			if now.Sub(pending.addedAt) > s.requestTTL {
+				delete(shard.requests, pendingID)
+			}
+		}
+		shard.lastSweep = now
+	}
+	shard.requests[id] = p
+}
+
+// takeRequest removes the request from the store and returns it, or nil when there was none
+func (s *store) takeRequest(id uint32) *pendingRequest {
+	shard := s.requestShard(id)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	p := shard.requests[id]
+	delete(shard.requests, id)
+	return p
+}
+
+func (s *store) removeRequests(ids []uint32) {
+	for _, id := range ids {
+		shard := s.requestShard(id)
+		shard.mx.Lock()
+		delete(shard.requests, id)
+		shard.mx.Unlock()
+	}
+}
+
+func (s *store) requestCount() int {
+	count := 0
+	for n := range s.requestShards {
+		shard := &s.requestShards[n]
+		shard.mx.RLock()
+		count += len(shard.requests)
+		shard.mx.RUnlock()
+	}
+	return count
+}
@@ -0,0 +1,360 @@
+package session
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/apisix-go-plugin-runner/pkg/runner"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestStoreConcurrentRemoval(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, WithStoreShards(4))
+	const sessions = 200
+	for n := 0; n < sessions; n++ {
+		sess := &session{sessionID: strconv.Itoa(n), reqID: []uint32{uint32(n)}}
+		i.createSession(uint32(n), &pendingRequest{sess: sess})
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ { //Every session is removed by several workers at once, as a timeout racing a revocation would
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; n < sessions; n++ {
+				switch worker % 3 {
+				case 0:
+					i.removeSession(strconv.Itoa(n), reasonTimeout)
+				case 1:
+					i.removeSession(strconv.Itoa(n), reasonRevoked)
+				default:
+					i.takePendingRequest(uint32(n))
+					i.getSession(strconv.Itoa(n))
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if n := i.store.sessionCount(); n != 0 {
+		t.Fatalf("expected every session to be removed, found %d", n)
+	}
+	if n := i.store.requestCount(); n != 0 {
+		t.Fatalf("expected the requests of removed sessions to be forgotten, found %d", n)
+	}
+	removed := testutil.ToFloat64(i.metrics.sessionsRemoved.WithLabelValues(reasonTimeout)) + testutil.ToFloat64(i.metrics.sessionsRemoved.WithLabelValues(reasonRevoked))
+	if removed != sessions {
+		t.Fatalf("expected each session to be counted as removed once, found %v removals", removed)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, WithStoreShards(1), WithMaxSessions(3, 2))
+	var next uint32
+	add := func(id string, authenticated bool) {
+		next++
+		i.createSession(next, &pendingRequest{sess: &session{sessionID: id, reqID: []uint32{next}, authenticated: authenticated}})
+	}
+	type testCase struct {
+		name        string
+		description string
+		act         func()
+		stored      []string
+	}
+	testCases := []testCase{
+		{
+			name:        "TestWithinLimits",
+			description: "Nothing should be evicted within the limits",
+			act:         func() { add("a", true); add("b", false); add("c", false) },
+			stored:      []string{"a", "b", "c"},
+		},
+		{
+			name:        "TestUnauthenticatedLimit",
+			description: "The least recently used unauthenticated session should be evicted beyond the lower limit",
+			act:         func() { add("d", false) },
+			stored:      []string{"a", "c", "d"},
+		},
+		{
+			name:        "TestUnauthenticatedFirst",
+			description: "Beyond the limit, unauthenticated sessions should be evicted first, least recently used first",
+			act:         func() { i.getSession("c"); add("e", true) },
+			stored:      []string{"a", "c", "e"},
+		},
+		{
+			name:        "TestAuthenticatedLRU",
+			description: "Without unauthenticated sessions, the least recently used authenticated session should be evicted",
+			act: func() {
+				sess := i.getSession("c")
+				sess.mx.Lock()
+				i.markAuthenticated(sess)
+				sess.mx.Unlock()
+				add("f", true)
+			},
+			stored: []string{"c", "e", "f"},
+		},
+		{
+			name:        "TestLoweredLimit",
+			description: "Sessions beyond a lowered limit should be evicted right away, least recently used first",
+			act:         func() { i.getSession("c"); i.SetSessionLimits(1, 1) },
+			stored:      []string{"c"},
+		},
+		{
+			name:        "TestRaisedLimit",
+			description: "A raised limit should make room for more sessions",
+			act:         func() { i.SetSessionLimits(3, 0); add("g", false); add("h", false) },
+			stored:      []string{"c", "g", "h"},
+		},
+	}
+	for _, tt := range testCases {
+		tt.act()
+		var stored []string
+		for _, sess := range i.listSessions() {
+			stored = append(stored, sess.sessionID)
+		}
+		sort.Strings(stored)
+		if fmt.Sprint(stored) != fmt.Sprint(tt.stored) {
+			t.Fatalf("%s: %s: expected sessions %v, found %v", tt.name, tt.description, tt.stored, stored)
+		}
+	}
+	if n := testutil.ToFloat64(i.metrics.sessionsRemoved.WithLabelValues(reasonEvicted)); n != 5 {
+		t.Fatalf("expected 5 evictions to be counted, found %v", n)
+	}
+	if n := i.store.requestCount(); n != 3 {
+		t.Fatalf("expected the requests of evicted sessions to be forgotten, found %d pending", n)
+	}
+}
+
+func TestStoreCapacity(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, WithStoreShards(32), WithMaxSessions(50, 0))
+	for n := 0; n < 200; n++ {
+		i.addSession(&session{sessionID: strconv.Itoa(n), expiresAt: time.Now().Add(time.Hour)})
+		if sess := i.getSession(strconv.Itoa(n)); sess != nil {
+			i.expireAfter(sess)
+		}
+	}
+	if n := i.store.sessionCount(); n != 50 || len(i.store.sessions()) != 50 {
+		t.Fatalf("expected the store to hold exactly its limit of 50 sessions over 32 shards, found %d", n)
+	}
+	if i.getSession("199") == nil {
+		t.Fatal("expected the session added last to be kept")
+	}
+}
+
+func TestExpiryStopped(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	sess := &session{sessionID: "a", expiresAt: time.Now().Add(time.Hour)}
+	i.addSession(sess)
+	i.expireAfter(sess)
+	if !i.removeSession("a", reasonRevoked) || i.removeSession("a", reasonRevoked) {
+		t.Fatal("expected only the first removal of the session to report it removed")
+	}
+	if sess.expiry.Load().Stop() {
+		t.Fatal("expected the expiry timer to be stopped with the removal of its session")
+	}
+}
+
+func TestPendingRequestTTL(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)}, WithStoreShards(1), WithPendingRequestTTL(200*time.Millisecond))
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid","createOn":"upstream"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := uint32(1); n <= 100; n++ { //Anonymous requests APISIX ends before post-resp, e.g. rejected by a later plugin
+		i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, &MockRequest{id: n, readheader: mockHeader{}})
+	}
+	if n := i.store.requestCount(); n != 100 {
+		t.Fatalf("expected the deferred requests to be pending, found %d", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, &MockRequest{id: 101, readheader: mockHeader{}})
+	if n := i.store.requestCount(); n != 1 {
+		t.Fatalf("expected the requests pending beyond the TTL to be swept, found %d pending", n)
+	}
+}
+
+func TestStoreFlood(t *testing.T) {
+	i := New(runner.RunnerConfig{LogLevel: zapcore.ErrorLevel, LogOutput: zapcore.AddSync(ioutil.Discard)}, WithMaxSessions(100, 10))
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid","customKeyAuth":"auth-one"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var next uint32
+	request := func(key string) *MockRequest {
+		next++
+		req := &MockRequest{id: next, readheader: mockHeader{header: map[string]string{CUSTOMAPIKEY: key}}}
+		i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+		i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: next + 1, statuscode: 200})
+		return req
+	}
+	var clients []string
+	for n := 0; n < 5; n++ {
+		clients = append(clients, strings.TrimPrefix(request("auth-one").readheader.header["Cookie"], "sid="))
+	}
+	for n := 0; n < 1000; n++ { //Requests without cookie, each of them creates a session
+		request("wrong")
+	}
+	if n := i.store.sessionCount(); n > 10+len(clients) {
+		t.Fatalf("expected unauthenticated sessions to be bounded by their limit, found %d sessions", n)
+	}
+	for _, sid := range clients {
+		if i.getSession(sid) == nil {
+			t.Fatalf("expected the session %s of an authenticated client to survive the flood", sid)
+		}
+	}
+}
+
+// TestVarsOutsideSessionLock checks that the vars, each a round trip to APISIX, are asked for while other requests of the session can go on
+func TestVarsOutsideSessionLock(t *testing.T) {
+	i := New(runner.RunnerConfig{LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid","csrf":true,"stickyUpstream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := &session{sessionID: "live", csrfToken: "token"}
+	i.addSession(sess)
+	var calls, locked int
+	onVar := func() {
+		calls++
+		if !sess.mx.TryLock() {
+			locked++
+			return
+		}
+		sess.mx.Unlock()
+	}
+	w := &MockResponseWriter{responseHeader: make(http.Header)}
+	i.RequestFilter(cfg, w, &MockRequest{id: 1, method: http.MethodPost, onVar: onVar, vars: map[string][]byte{"scheme": []byte("https")}, readheader: mockHeader{header: map[string]string{
+		"Cookie": "sid=live; csrf_token=token", "X-CSRF-Token": "token", "Host": "shop.example.com", "Origin": "https://shop.example.com",
+	}}})
+	if w.statuscode != 0 {
+		t.Fatalf("expected the same-origin request to pass, found status %d", w.statuscode)
+	}
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: 2, statuscode: 200, onVar: onVar, vars: map[string][]byte{"upstream_addr": []byte("10.0.0.1:80")}})
+	if calls != 2 || locked != 0 {
+		t.Fatalf("expected the scheme and upstream_addr to be asked for without holding the session lock, found %d of %d calls under it", locked, calls)
+	}
+	if sess.upstream != "10.0.0.1:80" {
+		t.Fatalf("expected the session to be pinned, found %q", sess.upstream)
+	}
+}
+
+// TestSessionConcurrentRequests hammers a single session with requests and responses from many goroutines while the admin API
+// and the snapshot read it. It is meant to be run with -race.
+func TestSessionConcurrentRequests(t *testing.T) {
+	i := New(runner.RunnerConfig{LogLevel: zapcore.ErrorLevel, LogOutput: zapcore.AddSync(ioutil.Discard)})
+	cfg, err := i.ParseConf([]byte(`{"cookie":"sid","customKeyAuth":"auth-one","failureLimit":3,"circuitBreaker":{"coolDownInSeconds":1},"stickyUpstream":true,"cohorts":{"stable":1,"canary":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var next uint32
+	request := func(cookie string) *MockRequest {
+		req := &MockRequest{id: atomic.AddUint32(&next, 1), readheader: mockHeader{header: map[string]string{CUSTOMAPIKEY: "auth-one"}}}
+		if cookie != "" {
+			req.readheader.header["Cookie"] = cookie
+		}
+		return req
+	}
+	first := request("")
+	i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, first)
+	i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: first.id + 1, statuscode: 200})
+	cookie := first.readheader.header["Cookie"]
+	sid := strings.TrimPrefix(cookie, "sid=")
+	if i.getSession(sid) == nil {
+		t.Fatal("expected the first request to create a session")
+	}
+
+	const workers, requests = 16, 200
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; n < requests; n++ {
+				req := request(cookie)
+				if n%5 == 0 {
+					req.readheader.header[CUSTOMAPIKEY] = "" //Served from the key stored in the session
+				}
+				i.RequestFilter(cfg, &MockResponseWriter{responseHeader: make(http.Header)}, req)
+				status := 200
+				if (worker+n)%7 == 0 {
+					status = 502
+				}
+				upstream := []byte("10.0.0." + strconv.Itoa(worker%3+1) + ":80")
+				i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: req.id + 1, statuscode: status, vars: map[string][]byte{"upstream_addr": upstream}})
+			}
+		}(worker)
+	}
+	admin := i.AdminHandler("admin-secret")
+	snapshot := filepath.Join(t.TempDir(), "sessions.snapshot")
+	wg.Add(1)
+	go func() { //Reads every field of the session while it is being changed
+		defer wg.Done()
+		for n := 0; n < requests; n++ {
+			req := httptest.NewRequest(http.MethodGet, "/sessions?q="+sid[:8], nil)
+			req.Header.Set("Authorization", "Bearer admin-secret")
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected the session list, found status %d", rec.Code)
+				return
+			}
+			if err := i.WriteSnapshot(snapshot, nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if n := i.store.requestCount(); n != 0 {
+		t.Fatalf("expected every request to be answered, found %d pending", n)
+	}
+	if i.getSession(sid) == nil {
+		t.Fatal("expected the session to survive with its circuit breaker instead of being removed")
+	}
+}
+
+// BenchmarkRequestFilter_Parallel compares the sharded store with a single shard, i.e. one lock for every session as before,
+// under concurrent requests of existing sessions with a new session every tenth request
+func BenchmarkRequestFilter_Parallel(b *testing.B) {
+	for _, shards := range []int{1, defaultStoreShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			i := New(runner.RunnerConfig{LogLevel: zapcore.WarnLevel, LogOutput: zapcore.AddSync(ioutil.Discard)}, WithStoreShards(shards))
+			ids := make([]string, 1024)
+			for n := range ids {
+				ids[n] = uuid.New().String()
+				i.store.addSession(&session{sessionID: ids[n]}, false)
+			}
+			cfg, err := i.ParseConf([]byte(`{"cookie":"test-id"}`)) //Parsed configs carry their fingerprint, as in APISIX
+			if err != nil {
+				b.Fatal(err)
+			}
+			var next uint32
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				res := &MockResponseWriter{responseHeader: make(http.Header)}
+				for n := 0; pb.Next(); n++ {
+					id := atomic.AddUint32(&next, 1)
+					req := &MockRequest{id: id, readheader: mockHeader{header: map[string]string{}}}
+					if n%10 != 0 {
+						req.readheader.header["Cookie"] = "test-id=" + ids[id%uint32(len(ids))]
+					}
+					i.RequestFilter(cfg, res, req)
+					i.ResponseFilter(cfg, &MockAPISIXResponseWriter{resid: id + 1, statuscode: 200})
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Revolyssup/apisix-session-manager/session"
+
+// Outcomes of the authentication done by the plugin, recorded on the RequestFilter span
+const (
+	authNone     = "none"
+	authAccepted = "accepted"
+	authRejected = "rejected"
+)
+
+// Option customizes an Instance created by New
+type Option func(*Instance)
+
+// WithTracerProvider makes the instance create its spans with tp instead of the global tracer provider
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(i *Instance) {
+		i.tracer = tp.Tracer(tracerName)
+	}
+}
+
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// headerCarrier lets the W3C trace context propagator read the traceparent header of a request
+type headerCarrier struct {
+	header apisixHTTP.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	return c.header.Get(key)
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c.header.Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	return nil
+}
+
+// traceParent returns the trace context the client sent with the request. RequestFilter keeps it with the pending request, so that the span of
+// ResponseFilter joins the same trace without asking APISIX for the request headers again.
+func traceParent(h apisixHTTP.Header) trace.SpanContext {
+	return trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), headerCarrier{h}))
+}
+
+// startSpan starts the span of a filter call which began at start, as a child of parent when the client sent a trace context
+func (i *Instance) startSpan(name string, parent trace.SpanContext, start time.Time) trace.Span {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	_, span := i.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal), trace.WithTimestamp(start))
+	return span
+}
+
+// filterTrace collects what a filter call did with the session, to be recorded on its span once the call is over
+type filterTrace struct {
+	sess         *session
+	isNew        bool
+	auth         string
+	storeLatency time.Duration
+}
+
+// timeStore measures a call into the session store
+func (t *filterTrace) timeStore(start time.Time) {
+	t.storeLatency += time.Since(start)
+}
+
+// endSpan records what the filter call did on its span and ends it
+func (i *Instance) endSpan(t *filterTrace, span trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.Bool("session.new", t.isNew),
+		attribute.String("session.auth", t.auth),
+		attribute.Int64("session.store_latency_us", t.storeLatency.Microseconds()),
+	}
+	if t.sess != nil {
+		attrs = append(attrs, attribute.String("session.id_hash", i.fingerprint(t.sess.sessionID)))
+	}
+	span.SetAttributes(attrs...)
+	span.End()
+}
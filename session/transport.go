@@ -0,0 +1,82 @@
+package session
+
+import (
+	"net/http"
+
+	apisixHTTP "github.com/apache/apisix-go-plugin-runner/pkg/http"
+)
+
+// Values of Config.Transport, i.e. how the session ID travels between the client and the runner
+const (
+	transportCookie = "cookie" //In the cookie named by Config.CookieName, for browsers
+	transportHeader = "header" //In a header of its own, for clients which do not handle cookies
+)
+
+const defaultTokenHeader = "X-Session-Token"
+
+func (c Config) transport() string {
+	if c.Transport != "" {
+		return c.Transport
+	}
+	return transportCookie
+}
+
+func (c Config) tokenHeader() string {
+	if c.TokenHeader != "" {
+		return c.TokenHeader
+	}
+	return defaultTokenHeader
+}
+
+// sessionTokens returns the session IDs the client presented. A client may hold several session cookies, e.g. set for different paths.
+// chunks is the number of cookies a token too large for one cookie was split into, see splitCookie.
+func (c Config) sessionTokens(r apisixHTTP.Request) (sids []string, chunks int) {
+	if c.transport() == transportHeader {
+		if sid := r.Header().Get(c.tokenHeader()); sid != "" {
+			return []string{sid}, 0
+		}
+		return nil, 0
+	}
+	return chunkedCookieValues(requestCookies(r.Header()), c.CookieName)
+}
+
+// passSessionToken puts the ID of a new session in the request, so that the upstream and chash load balancing see it as if the client had sent it
+func (c Config) passSessionToken(r apisixHTTP.Request, sid string) {
+	if c.transport() == transportHeader {
+		r.Header().Set(c.tokenHeader(), sid)
+		return
+	}
+	r.Header().Set("Cookie", setCookieValue(requestCookies(r.Header()), c.CookieName, sid)) //This is useful for sticky sessions. When the sid key that is passed to this plugin is used for chash loadbalancing in upstream
+}
+
+// stripSessionToken hides the session ID the client presented from the upstream
+func (c Config) stripSessionToken(r apisixHTTP.Request) {
+	if c.transport() == transportHeader {
+		r.Header().Del(c.tokenHeader())
+		return
+	}
+	removeCookie(r.Header(), c.CookieName)
+}
+
+// returnSessionToken hands the session ID to the client with the response RequestFilter answers the request with.
+// staleChunks is the number of cookies the token the client presented was split into.
+func (c Config) returnSessionToken(h http.Header, sid string, staleChunks int) {
+	if c.transport() == transportHeader {
+		h.Set(c.tokenHeader(), sid)
+		return
+	}
+	h.Del("Set-Cookie")
+	for _, cookie := range splitCookie(c.CookieName, sid, staleChunks) { //All values of the headers of the runner's own responses reach the client
+		h.Add("Set-Cookie", cookie)
+	}
+}
+
+// addSessionToken hands the session ID to the client with the upstream response, keeping the cookies the upstream set.
+// staleChunks is the number of cookies the token the client presented was split into.
+func (c Config) addSessionToken(h apisixHTTP.Header, sid string, staleChunks int) {
+	if c.transport() == transportHeader {
+		h.Set(c.tokenHeader(), sid)
+		return
+	}
+	appendSetCookie(h, c.CookieName, splitCookie(c.CookieName, sid, staleChunks))
+}